@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// errNoBaseTimestamp is returned when a cached response carries no
+// osm3s.timestamp_osm_base to diff from, e.g. one written before incremental
+// updates existed. Callers fall back to re-downloading the full result.
+var errNoBaseTimestamp = errors.New("cached response has no timestamp_osm_base")
+
+const (
+	changeAdded    = "added"
+	changeModified = "modified"
+	changeDeleted  = "deleted"
+)
+
+// elementChange records one element an incremental update added, modified or
+// deleted. For deletions, element is the last version seen before removal, so
+// its tags can still be used to name the POI that disappeared.
+type elementChange struct {
+	action  string
+	element element
+}
+
+// updateCachedResponse refreshes the cached response at path by asking Overpass
+// for an augmented diff of renderedQuery since the cached result's
+// timestamp_osm_base, merging that delta into the cached elements and writing
+// the merged result back to the cache. It returns the merged elements along
+// with the changes applied.
+func updateCachedResponse(
+	ctx context.Context,
+	cacheDir string,
+	makeQueryRequest func(ctx context.Context, query string) (*http.Response, error),
+	renderedQuery string,
+	path string,
+) ([]element, []elementChange, error) {
+	cachedBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading cached result(%s): %w", path, err)
+	}
+	var cached response
+	if err := json.Unmarshal(cachedBytes, &cached); err != nil {
+		return nil, nil, fmt.Errorf("decoding cached result(%s): %w", path, err)
+	}
+	if cached.OSM3S.TimestampOSMBase == "" {
+		return nil, nil, errNoBaseTimestamp
+	}
+	since := cached.OSM3S.TimestampOSMBase
+
+	diffQuery, err := renderAugmentedDiffQuery(renderedQuery, since)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rendering augmented diff query: %w", err)
+	}
+
+	slog.Info("requesting changes since cached result", "since", since, "query", renderedQuery[:min(80, len(renderedQuery))])
+	resp, err := makeQueryRequest(ctx, diffQuery)
+	if err != nil {
+		return nil, nil, fmt.Errorf("posting augmented diff query: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, nil, newHTTPStatusError(resp)
+	}
+	var diff augmentedDiff
+	if err := xml.NewDecoder(resp.Body).Decode(&diff); err != nil {
+		_ = resp.Body.Close()
+		return nil, nil, fmt.Errorf("decoding augmented diff: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		return nil, nil, fmt.Errorf("closing response body: %w", err)
+	}
+	if remarkErr := parseRemark(diff.Remark); remarkErr != nil {
+		return nil, nil, remarkErr
+	}
+	if diff.Meta.OSMBase == "" {
+		return nil, nil, errors.New("augmented diff has no osm_base timestamp")
+	}
+
+	merged, changes := mergeAugmentedDiff(cached.Elements, diff)
+	cached.Elements = merged
+	cached.OSM3S.TimestampOSMBase = diff.Meta.OSMBase
+
+	// Rewriting the entry also refreshes its mtime, restarting the TTL.
+	mergedBytes, err := json.Marshal(cached)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding merged result: %w", err)
+	}
+	if err := atomicSlurp(cacheDir, bytes.NewReader(mergedBytes), path, nil); err != nil {
+		return nil, nil, fmt.Errorf("storing merged result into cache: %w", err)
+	}
+	slog.Info("applied changes to cached result", "changes", len(changes), "since", since, "now", diff.Meta.OSMBase)
+	return merged, changes, nil
+}
+
+// renderAugmentedDiffQuery derives the augmented diff form of a query rendered
+// by renderUnionQuery by rewriting its leading settings statement, leaving the
+// query body byte-for-byte identical to the one whose result was cached.
+// Overpass only emits augmented diffs as XML, hence the change of output format.
+func renderAugmentedDiffQuery(renderedQuery string, since string) (string, error) {
+	settings, body, ok := strings.Cut(renderedQuery, ";")
+	if !ok || !strings.HasPrefix(settings, "[out:json]") {
+		return "", fmt.Errorf("query does not start with an [out:json] settings statement: %q", renderedQuery[:min(80, len(renderedQuery))])
+	}
+	settings = "[out:xml]" + strings.TrimPrefix(settings, "[out:json]") + fmt.Sprintf("[adiff:%q]", since)
+	return settings + ";" + body, nil
+}
+
+// augmentedDiff is the XML document Overpass returns for an [adiff:...] query.
+type augmentedDiff struct {
+	Meta struct {
+		OSMBase string `xml:"osm_base,attr"`
+	} `xml:"meta"`
+	Actions []adiffAction `xml:"action"`
+	Remark  string        `xml:"remark"`
+}
+
+// adiffAction is one change in an augmented diff. A create carries the new
+// element directly; modify and delete carry both versions in <old> and <new>.
+type adiffAction struct {
+	Type string `xml:"type,attr"` // "create", "modify" or "delete"
+	xmlElements
+	Old xmlElements `xml:"old"`
+	New xmlElements `xml:"new"`
+}
+
+type xmlElements struct {
+	Nodes     []xmlNode     `xml:"node"`
+	Ways      []xmlWay      `xml:"way"`
+	Relations []xmlRelation `xml:"relation"`
+}
+
+type xmlTag struct {
+	Key   string `xml:"k,attr"`
+	Value string `xml:"v,attr"`
+}
+
+type xmlNode struct {
+	ID   int64    `xml:"id,attr"`
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Tags []xmlTag `xml:"tag"`
+}
+
+// xmlNd is a way node reference; with `out geom` it carries the node's location.
+type xmlNd struct {
+	Ref int64   `xml:"ref,attr"`
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+}
+
+// xmlCenter is a way or relation's centre, returned by `out center`.
+type xmlCenter struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+}
+
+type xmlWay struct {
+	ID     int64      `xml:"id,attr"`
+	Center *xmlCenter `xml:"center"`
+	Nds    []xmlNd    `xml:"nd"`
+	Tags   []xmlTag   `xml:"tag"`
+}
+
+type xmlMember struct {
+	Type string  `xml:"type,attr"`
+	Ref  int64   `xml:"ref,attr"`
+	Role string  `xml:"role,attr"`
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Nds  []xmlNd `xml:"nd"`
+}
+
+type xmlRelation struct {
+	ID      int64       `xml:"id,attr"`
+	Center  *xmlCenter  `xml:"center"`
+	Members []xmlMember `xml:"member"`
+	Tags    []xmlTag    `xml:"tag"`
+}
+
+// elements converts the XML elements into the same form as the JSON API
+// response, so merged results are indistinguishable from a full download.
+func (xe xmlElements) elements() []element {
+	var es []element
+	for _, n := range xe.Nodes {
+		es = append(es, element{Type: "node", ID: n.ID, Lat: n.Lat, Lon: n.Lon, Tags: xmlTags(n.Tags)})
+	}
+	for _, w := range xe.Ways {
+		e := element{Type: "way", ID: w.ID, Center: w.Center.latLon(), Tags: xmlTags(w.Tags)}
+		for _, nd := range w.Nds {
+			e.Nodes = append(e.Nodes, nd.Ref)
+			e.Geometry = append(e.Geometry, LatLon{Lat: nd.Lat, Lon: nd.Lon})
+		}
+		es = append(es, e)
+	}
+	for _, r := range xe.Relations {
+		e := element{Type: "relation", ID: r.ID, Center: r.Center.latLon(), Tags: xmlTags(r.Tags)}
+		for _, m := range r.Members {
+			em := member{Type: m.Type, Ref: m.Ref, Role: m.Role, Lat: m.Lat, Lon: m.Lon}
+			for _, nd := range m.Nds {
+				em.Geometry = append(em.Geometry, LatLon{Lat: nd.Lat, Lon: nd.Lon})
+			}
+			e.Members = append(e.Members, em)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+func (c *xmlCenter) latLon() *LatLon {
+	if c == nil {
+		return nil
+	}
+	return &LatLon{Lat: c.Lat, Lon: c.Lon}
+}
+
+func xmlTags(tags []xmlTag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[t.Key] = t.Value
+	}
+	return m
+}
+
+// mergeAugmentedDiff applies diff to the cached elements, returning the merged
+// element set and the changes applied. Elements keep their cached order, with
+// newly created elements appended.
+//
+// An element that stops matching the query (e.g. its tags changed) is reported
+// by Overpass as a delete even though it still exists in OSM; either way it is
+// no longer part of the result, so both are treated as a deletion.
+func mergeAugmentedDiff(cached []element, diff augmentedDiff) ([]element, []elementChange) {
+	type key struct {
+		Type string
+		ID   int64
+	}
+	merged := make([]*element, 0, len(cached))
+	index := make(map[key]int, len(cached))
+	for i := range cached {
+		e := cached[i]
+		index[key{e.Type, e.ID}] = len(merged)
+		merged = append(merged, &e)
+	}
+
+	upsert := func(e element) string {
+		k := key{e.Type, e.ID}
+		if i, ok := index[k]; ok && merged[i] != nil {
+			merged[i] = &e
+			return changeModified
+		}
+		index[k] = len(merged)
+		merged = append(merged, &e)
+		return changeAdded
+	}
+
+	var changes []elementChange
+	for _, action := range diff.Actions {
+		switch action.Type {
+		case "create":
+			for _, e := range action.elements() {
+				changes = append(changes, elementChange{action: upsert(e), element: e})
+			}
+		case "modify":
+			for _, e := range action.New.elements() {
+				changes = append(changes, elementChange{action: upsert(e), element: e})
+			}
+		case "delete":
+			for _, e := range action.Old.elements() {
+				k := key{e.Type, e.ID}
+				if i, ok := index[k]; ok && merged[i] != nil {
+					e = *merged[i]
+					merged[i] = nil
+				}
+				changes = append(changes, elementChange{action: changeDeleted, element: e})
+			}
+		}
+	}
+
+	elements := make([]element, 0, len(merged))
+	for _, e := range merged {
+		if e != nil {
+			elements = append(elements, *e)
+		}
+	}
+	return elements, changes
+}
+
+// logElementChanges reports the POIs that incremental cache updates found to
+// have been added, modified or deleted since the last run. Neighbouring splits'
+// search areas overlap, so the same element may be reported by more than one
+// split; it is only listed once.
+func logElementChanges(results []workResult) {
+	type key struct {
+		Type string
+		ID   int64
+	}
+	seen := make(map[key]struct{})
+	counts := make(occurrences[string])
+	var lines []string
+	for _, result := range results {
+		for _, c := range result.changes {
+			k := key{c.element.Type, c.element.ID}
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			counts.mark(c.action)
+			name, err := resolveName(c.element.Tags)
+			if err != nil {
+				name = "(unnamed)"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s/%d %s", c.action, c.element.Type, c.element.ID, name))
+		}
+	}
+	if len(seen) == 0 {
+		return
+	}
+	slog.Info("changes since last run",
+		"added", counts[changeAdded], "modified", counts[changeModified], "deleted", counts[changeDeleted])
+	for _, line := range lines {
+		slog.Info("- " + line)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func Test_renderAugmentedDiffQuery(t *testing.T) {
+	actual, err := renderAugmentedDiffQuery("[out:json][timeout:180];\n(\n  node[amenity];\n);\nout geom qt;", "2024-01-02T03:04:05Z")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "[out:xml][timeout:180][adiff:\"2024-01-02T03:04:05Z\"];\n(\n  node[amenity];\n);\nout geom qt;"
+	if actual != expected {
+		t.Fatalf("Expected %q to be %q", actual, expected)
+	}
+}
+
+func Test_mergeAugmentedDiff(t *testing.T) {
+	const body = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6" generator="Overpass API">
+<meta osm_base="2024-02-01T00:00:00Z"/>
+<action type="create">
+  <node id="3" lat="1.5" lon="2.5"><tag k="amenity" v="cafe"/></node>
+</action>
+<action type="modify">
+  <old><way id="2"><nd ref="10" lat="1" lon="1"/><nd ref="11" lat="2" lon="2"/><tag k="shop" v="bakery"/></way></old>
+  <new><way id="2"><nd ref="10" lat="1" lon="1"/><nd ref="11" lat="2" lon="2"/><tag k="shop" v="bakery"/><tag k="opening_hours" v="Mo-Fr 08:00-12:00"/></way></new>
+</action>
+<action type="delete">
+  <old><node id="1" lat="0" lon="0"><tag k="amenity" v="pub"/></node></old>
+  <new><node id="1" visible="false"/></new>
+</action>
+</osm>`
+	var diff augmentedDiff
+	if err := xml.NewDecoder(strings.NewReader(body)).Decode(&diff); err != nil {
+		t.Fatalf("decoding diff: %v", err)
+	}
+	if diff.Meta.OSMBase != "2024-02-01T00:00:00Z" {
+		t.Fatalf("unexpected osm_base %q", diff.Meta.OSMBase)
+	}
+
+	cached := []element{
+		{Type: "node", ID: 1, Tags: map[string]string{"amenity": "pub", "name": "The Crown"}},
+		{Type: "way", ID: 2, Tags: map[string]string{"shop": "bakery"}},
+	}
+	merged, changes := mergeAugmentedDiff(cached, diff)
+
+	if len(merged) != 2 {
+		t.Fatalf("expected 2 merged elements, got %d: %+v", len(merged), merged)
+	}
+	if merged[0].Type != "way" || merged[0].Tags["opening_hours"] != "Mo-Fr 08:00-12:00" || len(merged[0].Geometry) != 2 {
+		t.Fatalf("way was not updated in place: %+v", merged[0])
+	}
+	if merged[1].Type != "node" || merged[1].ID != 3 || merged[1].Lat != 1.5 {
+		t.Fatalf("created node was not appended: %+v", merged[1])
+	}
+
+	want := map[int64]string{3: changeAdded, 2: changeModified, 1: changeDeleted}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %+v", len(want), changes)
+	}
+	for _, c := range changes {
+		if want[c.element.ID] != c.action {
+			t.Fatalf("expected %s/%d to be %s, got %s", c.element.Type, c.element.ID, want[c.element.ID], c.action)
+		}
+	}
+	// Deletions report the cached version so the POI can still be named.
+	for _, c := range changes {
+		if c.action == changeDeleted && c.element.Tags["name"] != "The Crown" {
+			t.Fatalf("deleted element lost its cached tags: %+v", c.element)
+		}
+	}
+}
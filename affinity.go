@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// endpointAffinityFile is the file in the cache dir recording which endpoint
+// last fetched each cached query.
+const endpointAffinityFile = "endpoint-affinity.json"
+
+// endpointAffinity maps a query's cache key to the endpoint that last fetched
+// it from the API. When the cached result expires, the query is routed back to
+// that endpoint first, which may still have the data it touched warm.
+type endpointAffinity map[string]string
+
+func loadEndpointAffinity(cacheDir string) (endpointAffinity, error) {
+	b, err := os.ReadFile(filepath.Join(cacheDir, endpointAffinityFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return endpointAffinity{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading endpoint affinity: %w", err)
+	}
+	affinity := endpointAffinity{}
+	if err := json.Unmarshal(b, &affinity); err != nil {
+		return nil, fmt.Errorf("decoding endpoint affinity: %w", err)
+	}
+	return affinity, nil
+}
+
+// assign sets each unit's preferred endpoint to the one that last fetched its
+// query.
+func (a endpointAffinity) assign(units []workUnit, settings querySettings) {
+	for i, u := range units {
+		renderedQuery, err := renderUnionQuery(u.queries, u.routePoints, settings)
+		if err != nil {
+			// processWorkUnit reports this when it renders the query itself.
+			slog.Debug("rendering query for endpoint affinity", "split", u.splitIndex+1, "err", err)
+			continue
+		}
+		units[i].preferred = a[cacheKey(renderedQuery)]
+	}
+}
+
+// record notes the endpoint that fetched each result's query.
+func (a endpointAffinity) record(results []workResult) {
+	for _, r := range results {
+		if r.queryKey != "" {
+			a[r.queryKey] = r.endpoint
+		}
+	}
+}
+
+// save writes the affinity to the cache dir, dropping entries whose cached
+// result has since been removed.
+func (a endpointAffinity) save(cacheDir string) error {
+	for key := range a {
+		if _, err := os.Stat(filepath.Join(cacheDir, key)); errors.Is(err, os.ErrNotExist) {
+			delete(a, key)
+		}
+	}
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding endpoint affinity: %w", err)
+	}
+	if err := atomicSlurp(cacheDir, bytes.NewReader(b), filepath.Join(cacheDir, endpointAffinityFile), nil); err != nil {
+		return fmt.Errorf("writing endpoint affinity: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	gpxgo "github.com/tkrajina/gpxgo/gpx"
+)
+
+func Test_endpointAffinity(t *testing.T) {
+	dir := t.TempDir()
+	unit := workUnit{
+		queries:     []query{{conditions: []condition{{tag: "amenity", values: []string{"cafe"}}}}},
+		routePoints: []gpxgo.GPXPoint{{Point: gpxgo.Point{Latitude: 51, Longitude: -1}}},
+	}
+	renderedQuery, err := renderUnionQuery(unit.queries, unit.routePoints, querySettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := cacheKey(renderedQuery)
+	if err := os.WriteFile(filepath.Join(dir, key), []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	affinity := endpointAffinity{"gone": "de"}
+	affinity.record([]workResult{{endpoint: "pc", queryKey: key}, {}})
+	if err := affinity.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadEndpointAffinity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 {
+		t.Errorf("expected the entry without a cached result to be dropped, got %v", loaded)
+	}
+	units := []workUnit{unit}
+	loaded.assign(units, querySettings{})
+	if units[0].preferred != "pc" {
+		t.Errorf("expected the unit to prefer pc, got %q", units[0].preferred)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+)
+
+// changeRemoved marks a feature present in the old run but not the new one.
+// Additions and modifications reuse changeAdded and changeModified.
+const changeRemoved = "removed"
+
+// tagChange describes one tag whose value differs between two runs. Old is
+// empty when the tag was gained and New is empty when it was lost.
+type tagChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// featureChange is the difference between the features sharing one id across
+// two runs. A way or relation crossing the route several times is written as
+// several features with the same id, so each side holds every feature for the
+// id rather than just one.
+type featureChange struct {
+	id     string
+	change string // changeAdded, changeRemoved or changeModified
+	old    []feature
+	new    []feature
+	tags   []tagChange
+	moved  bool
+}
+
+// changeFeature is a Feature in the `diff` subcommand's GeoJSON output. Its
+// properties are those of the feature it describes, plus what changed.
+type changeFeature struct {
+	Type       string           `json:"type"` // always "Feature"
+	ID         string           `json:"id"`
+	Geometry   geometry         `json:"geometry"`
+	Properties changeProperties `json:"properties"`
+}
+
+type changeProperties struct {
+	featureProperties
+	Change     string      `json:"change"`
+	TagChanges []tagChange `json:"tag_changes,omitempty"`
+	// Moved is set when the feature's location(s) differ between the runs.
+	Moved bool `json:"moved,omitempty"`
+}
+
+type changeFeatureCollection struct {
+	Type     string          `json:"type"` // always "FeatureCollection"
+	Features []changeFeature `json:"features"`
+}
+
+// diffMain implements `diff [flags] OLD.geojson NEW.geojson`, comparing the
+// output of two runs. A human-readable summary is written to stderr and a
+// GeoJSON FeatureCollection of the changed features to --out.
+func diffMain(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	out := fs.String(`out`, "-", `file to write GeoJSON of changes to, "-" writes to stdout`)
+	lf := registerLogFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		// The usage has been printed for -h already.
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	if err := lf.setDefault(); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: diff [flags] OLD.geojson NEW.geojson")
+	}
+
+	oldFC, err := readFeatureCollection(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("reading old features: %w", err)
+	}
+	newFC, err := readFeatureCollection(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("reading new features: %w", err)
+	}
+
+	changes := diffFeatureCollections(oldFC, newFC)
+	writeChangeSummary(os.Stderr, changes, len(oldFC.Features), len(newFC.Features))
+
+	w, wClose, err := openOutput(*out)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(changeFeatures(changes)); err != nil {
+		if wClose != nil {
+			_ = wClose()
+		}
+		return fmt.Errorf("writing changes geojson: %w", err)
+	}
+	if wClose != nil {
+		if err := wClose(); err != nil {
+			return fmt.Errorf("closing changes geojson writer: %w", err)
+		}
+	}
+	return nil
+}
+
+func readFeatureCollection(path string) (featureCollection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return featureCollection{}, fmt.Errorf("opening %s: %w", path, err)
+	}
+	var fc featureCollection
+	if err := json.NewDecoder(f).Decode(&fc); err != nil {
+		_ = f.Close()
+		return featureCollection{}, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return featureCollection{}, fmt.Errorf("closing %s: %w", path, err)
+	}
+	if fc.Type != "FeatureCollection" {
+		return featureCollection{}, fmt.Errorf("%s is not a GeoJSON FeatureCollection (type %q)", path, fc.Type)
+	}
+	return fc, nil
+}
+
+// diffFeatureCollections matches features across two runs by their
+// `node/123`-style id and returns the changes, sorted by id. Features whose
+// tags and locations are unchanged are omitted.
+func diffFeatureCollections(oldFC, newFC featureCollection) []featureChange {
+	byID := func(fc featureCollection) map[string][]feature {
+		m := make(map[string][]feature)
+		for _, f := range fc.Features {
+			m[f.ID] = append(m[f.ID], f)
+		}
+		return m
+	}
+	olds, news := byID(oldFC), byID(newFC)
+
+	var changes []featureChange
+	for id, o := range olds {
+		n, ok := news[id]
+		if !ok {
+			changes = append(changes, featureChange{id: id, change: changeRemoved, old: o})
+			continue
+		}
+		tags := diffTags(o[0].Properties.Tags, n[0].Properties.Tags)
+		moved := !slices.Equal(sortedCoordinates(o), sortedCoordinates(n))
+		if len(tags) > 0 || moved {
+			changes = append(changes, featureChange{id: id, change: changeModified, old: o, new: n, tags: tags, moved: moved})
+		}
+	}
+	for id, n := range news {
+		if _, ok := olds[id]; !ok {
+			changes = append(changes, featureChange{id: id, change: changeAdded, new: n})
+		}
+	}
+	slices.SortFunc(changes, func(a, b featureChange) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return changes
+}
+
+// diffTags returns the tags added, removed or changed between old and new,
+// sorted by key. Gaining a lifecycle-prefixed tag such as `disused:shop` shows
+// up here as an addition.
+func diffTags(old, new map[string]string) []tagChange {
+	var changes []tagChange
+	for _, k := range slices.Sorted(maps.Keys(old)) {
+		if nv, ok := new[k]; !ok {
+			changes = append(changes, tagChange{Key: k, Old: old[k]})
+		} else if nv != old[k] {
+			changes = append(changes, tagChange{Key: k, Old: old[k], New: nv})
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(new)) {
+		if _, ok := old[k]; !ok {
+			changes = append(changes, tagChange{Key: k, New: new[k]})
+		}
+	}
+	slices.SortStableFunc(changes, func(a, b tagChange) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return changes
+}
+
+func sortedCoordinates(fs []feature) [][2]float64 {
+	coords := make([][2]float64, 0, len(fs))
+	for _, f := range fs {
+		coords = append(coords, f.Geometry.Coordinates)
+	}
+	slices.SortFunc(coords, func(a, b [2]float64) int {
+		if c := cmp.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a[1], b[1])
+	})
+	return coords
+}
+
+// changeFeatures renders changes as GeoJSON. Removed features keep their old
+// location and properties; added and modified ones use the new.
+func changeFeatures(changes []featureChange) changeFeatureCollection {
+	fc := changeFeatureCollection{Type: "FeatureCollection", Features: []changeFeature{}}
+	for _, c := range changes {
+		fs := c.new
+		if c.change == changeRemoved {
+			fs = c.old
+		}
+		for _, f := range fs {
+			fc.Features = append(fc.Features, changeFeature{
+				Type:     "Feature",
+				ID:       f.ID,
+				Geometry: f.Geometry,
+				Properties: changeProperties{
+					featureProperties: f.Properties,
+					Change:            c.change,
+					TagChanges:        c.tags,
+					Moved:             c.moved,
+				},
+			})
+		}
+	}
+	return fc
+}
+
+// writeChangeSummary writes a human-readable summary of changes to w.
+func writeChangeSummary(w io.Writer, changes []featureChange, oldCount, newCount int) {
+	counts := make(occurrences[string])
+	for _, c := range changes {
+		counts.mark(c.change)
+	}
+	_, _ = fmt.Fprintf(w, "%d added, %d removed, %d modified (%d features before, %d after)\n",
+		counts[changeAdded], counts[changeRemoved], counts[changeModified], oldCount, newCount)
+
+	for _, section := range []struct {
+		change string
+		symbol string
+	}{
+		{changeAdded, "+"},
+		{changeRemoved, "-"},
+		{changeModified, "~"},
+	} {
+		for _, c := range changes {
+			if c.change != section.change {
+				continue
+			}
+			props := c.new
+			if c.change == changeRemoved {
+				props = c.old
+			}
+			_, _ = fmt.Fprintf(w, "%s %s %s (%s)\n", section.symbol, c.id, props[0].Properties.Name, props[0].Properties.Category)
+			for _, t := range c.tags {
+				switch {
+				case t.Old == "":
+					_, _ = fmt.Fprintf(w, "    + %s=%s\n", t.Key, t.New)
+				case t.New == "":
+					_, _ = fmt.Fprintf(w, "    - %s=%s\n", t.Key, t.Old)
+				default:
+					_, _ = fmt.Fprintf(w, "    ~ %s: %q -> %q\n", t.Key, t.Old, t.New)
+				}
+			}
+			if c.moved {
+				_, _ = fmt.Fprintf(w, "    location changed\n")
+			}
+		}
+	}
+}
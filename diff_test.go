@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testFeature(id string, lon, lat float64, tags map[string]string) feature {
+	return feature{
+		Type:       "Feature",
+		ID:         id,
+		Geometry:   geometry{Type: "Point", Coordinates: [2]float64{lon, lat}},
+		Properties: featureProperties{Name: tags["name"], Tags: tags},
+	}
+}
+
+func Test_diffFeatureCollections(t *testing.T) {
+	oldFC := featureCollection{Type: "FeatureCollection", Features: []feature{
+		testFeature("node/1", 1, 1, map[string]string{"name": "Kept", "shop": "bakery"}),
+		testFeature("node/2", 2, 2, map[string]string{"name": "Gone", "amenity": "pub"}),
+		testFeature("node/3", 3, 3, map[string]string{"name": "Closing", "shop": "convenience", "opening_hours": "Mo-Sa 08:00-18:00"}),
+		testFeature("way/4", 4, 4, map[string]string{"name": "River"}),
+		testFeature("way/4", 5, 5, map[string]string{"name": "River"}),
+	}}
+	newFC := featureCollection{Type: "FeatureCollection", Features: []feature{
+		// same crossings, listed in a different order
+		testFeature("way/4", 5, 5, map[string]string{"name": "River"}),
+		testFeature("way/4", 4, 4, map[string]string{"name": "River"}),
+		testFeature("node/1", 1, 1, map[string]string{"name": "Kept", "shop": "bakery"}),
+		testFeature("node/3", 3, 3, map[string]string{"name": "Closing", "disused:shop": "convenience", "opening_hours": "Mo-Sa 09:00-17:00"}),
+		testFeature("node/5", 6, 6, map[string]string{"name": "New", "amenity": "cafe"}),
+	}}
+
+	changes := diffFeatureCollections(oldFC, newFC)
+
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.id+" "+c.change)
+	}
+	expected := []string{"node/2 removed", "node/3 modified", "node/5 added"}
+	if !slices.Equal(expected, got) {
+		t.Fatalf("Expected %v to be %v", got, expected)
+	}
+
+	expectedTags := []tagChange{
+		{Key: "disused:shop", New: "convenience"},
+		{Key: "opening_hours", Old: "Mo-Sa 08:00-18:00", New: "Mo-Sa 09:00-17:00"},
+		{Key: "shop", Old: "convenience"},
+	}
+	if !slices.Equal(expectedTags, changes[1].tags) {
+		t.Fatalf("Expected %v to be %v", changes[1].tags, expectedTags)
+	}
+	if changes[1].moved {
+		t.Fatal("unmoved feature reported as moved")
+	}
+
+	fc := changeFeatures(changes)
+	if len(fc.Features) != 3 {
+		t.Fatalf("expected 3 change features, got %d", len(fc.Features))
+	}
+	if removed := fc.Features[0]; removed.Properties.Name != "Gone" || removed.Geometry.Coordinates != [2]float64{2, 2} {
+		t.Fatalf("removed feature should keep its old properties and location: %+v", removed)
+	}
+
+	var summary bytes.Buffer
+	writeChangeSummary(&summary, changes, len(oldFC.Features), len(newFC.Features))
+	if !strings.HasPrefix(summary.String(), "1 added, 1 removed, 1 modified") {
+		t.Fatalf("unexpected summary:\n%s", summary.String())
+	}
+}
+
+// A bad flag is returned as an error rather than exiting the process, and -h
+// isn't an error at all.
+func Test_diffMain_flags(t *testing.T) {
+	if err := diffMain([]string{"-no-such-flag"}); err == nil {
+		t.Error("expected an unknown flag to be an error")
+	}
+	if err := diffMain([]string{"-h"}); err != nil {
+		t.Errorf("expected -h not to be an error, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+	"gopkg.in/yaml.v3"
+)
+
+// endpointsConfig is the --endpoints-config file. For example:
+//
+//	user_agent: route-poi-finder (me@example.com)
+//	endpoints:
+//	  - name: de
+//	    interpreter: https://overpass-api.de/api/interpreter
+//	    status: https://overpass-api.de/api/status
+//	  - name: private
+//	    interpreter: https://overpass.example.com/api/interpreter
+//	    slots: 8
+//	    rate_per_minute: 30
+//	    timeout: 10m
+//	    priority: -1
+//	    headers:
+//	      Authorization: Bearer s3cr3t
+type endpointsConfig struct {
+	// UserAgent is the User-Agent of every endpoint that doesn't set its own.
+	UserAgent string         `yaml:"user_agent"`
+	Endpoints []endpointSpec `yaml:"endpoints"`
+}
+
+func loadEndpointsConfig(path string) ([]endpointSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening endpoints config: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	specs, err := parseEndpointsConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("endpoints config %s: %w", path, err)
+	}
+	return specs, nil
+}
+
+func parseEndpointsConfig(r io.Reader) ([]endpointSpec, error) {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	var conf endpointsConfig
+	if err := decoder.Decode(&conf); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("decoding: %w", err)
+	}
+	if len(conf.Endpoints) == 0 {
+		return nil, errors.New("no endpoints configured")
+	}
+	names := make(map[string]bool)
+	for i := range conf.Endpoints {
+		ep := &conf.Endpoints[i]
+		switch {
+		case ep.Name == "":
+			return nil, fmt.Errorf("endpoint %d has no name", i+1)
+		case names[ep.Name]:
+			return nil, fmt.Errorf("endpoint %q configured more than once", ep.Name)
+		case ep.Interpreter == "":
+			return nil, fmt.Errorf("endpoint %q has no interpreter URL", ep.Name)
+		case ep.Status == "" && ep.Slots == 0:
+			return nil, fmt.Errorf("endpoint %q needs a status URL, or slots for a server without one", ep.Name)
+		case ep.Slots < 0 || ep.Concurrency < 0 || ep.Timeout < 0 || ep.RatePerMinute < 0:
+			return nil, fmt.Errorf("endpoint %q: slots, concurrency, timeout and rate_per_minute must not be negative", ep.Name)
+		case ep.RatePerMinute > 0 && ep.Slots == 0:
+			return nil, fmt.Errorf("endpoint %q: rate_per_minute only applies to servers with fixed slots", ep.Name)
+		}
+		names[ep.Name] = true
+		if ep.UserAgent == "" {
+			ep.UserAgent = conf.UserAgent
+		}
+	}
+	return conf.Endpoints, nil
+}
+
+// clientOptions are the options configuring an Overpass client for the
+// endpoint.
+func (ep endpointSpec) clientOptions() []overpass.Option {
+	var opts []overpass.Option
+	if len(ep.Headers) > 0 {
+		header := make(http.Header)
+		for k, v := range ep.Headers {
+			header.Set(k, v)
+		}
+		opts = append(opts, overpass.WithHeader(header))
+	}
+	if ep.UserAgent != "" {
+		opts = append(opts, overpass.WithUserAgent(ep.UserAgent))
+	}
+	if ep.Slots > 0 {
+		opts = append(opts, overpass.WithFixedSlots(ep.Slots))
+	}
+	if ep.RatePerMinute > 0 {
+		opts = append(opts, overpass.WithRequestRate(ep.RatePerMinute))
+	}
+	return opts
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+)
+
+func Test_parseEndpointsConfig(t *testing.T) {
+	specs, err := parseEndpointsConfig(strings.NewReader(`
+user_agent: route-poi-finder (me@example.com)
+endpoints:
+  - name: de
+    interpreter: https://overpass-api.de/api/interpreter
+    status: https://overpass-api.de/api/status
+  - name: private
+    interpreter: https://overpass.example.com/api/interpreter
+    slots: 8
+    timeout: 10m
+    priority: -1
+    user_agent: private-runner
+    headers:
+      Authorization: Bearer s3cr3t
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []endpointSpec{{
+		Name:        "de",
+		Interpreter: "https://overpass-api.de/api/interpreter",
+		Status:      "https://overpass-api.de/api/status",
+		UserAgent:   "route-poi-finder (me@example.com)",
+	}, {
+		Name:        "private",
+		Interpreter: "https://overpass.example.com/api/interpreter",
+		Slots:       8,
+		Timeout:     10 * time.Minute,
+		Priority:    -1,
+		UserAgent:   "private-runner",
+		Headers:     map[string]string{"Authorization": "Bearer s3cr3t"},
+	}}
+	if !reflect.DeepEqual(specs, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, specs)
+	}
+
+	for name, conf := range map[string]string{
+		"empty":          ``,
+		"unknown field":  "endpoints:\n  - name: a\n    interpreter: x\n    status: y\n    colour: red\n",
+		"no status":      "endpoints:\n  - name: a\n    interpreter: x\n",
+		"duplicate name": "endpoints:\n  - {name: a, interpreter: x, slots: 1}\n  - {name: a, interpreter: y, slots: 1}\n",
+		"negative slots": "endpoints:\n  - {name: a, interpreter: x, status: y, slots: -1}\n",
+		"negative rate":  "endpoints:\n  - {name: a, interpreter: x, slots: 1, rate_per_minute: -1}\n",
+		"rate no slots":  "endpoints:\n  - {name: a, interpreter: x, status: y, rate_per_minute: 30}\n",
+	} {
+		if _, err := parseEndpointsConfig(strings.NewReader(conf)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// A fixed-slot server has no status endpoint, so the client must never fetch
+// one, and every query carries the configured headers.
+func Test_endpointSpec_clientOptions(t *testing.T) {
+	var statusFetched bool
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/status" {
+			statusFetched = true
+		}
+		got = r.Header.Clone()
+		_, _ = w.Write([]byte(`{"elements":[]}`))
+	}))
+	defer srv.Close()
+
+	ep := endpointSpec{
+		Interpreter: srv.URL + "/api/interpreter",
+		Slots:       2,
+		Headers:     map[string]string{"authorization": "Bearer s3cr3t"},
+		UserAgent:   "route-poi-finder (me@example.com)",
+	}
+	c := overpass.NewClient(ep.Interpreter, ep.Status, time.Second, ep.clientOptions()...)
+	defer c.Close()
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	if c.FixedSlots() != 2 {
+		t.Errorf("expected 2 fixed slots, got %d", c.FixedSlots())
+	}
+	resp, err := c.Query(context.Background(), "[out:json];out;")
+	if err != nil {
+		t.Fatalf("querying: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if statusFetched {
+		t.Error("expected no status fetch for a fixed-slot server")
+	}
+	if v := got.Get("Authorization"); v != "Bearer s3cr3t" {
+		t.Errorf("expected the configured Authorization header, got %q", v)
+	}
+	if v := got.Get("User-Agent"); v != ep.UserAgent {
+		t.Errorf("expected User-Agent %q, got %q", ep.UserAgent, v)
+	}
+	if err := c.Probe(context.Background()); err != nil {
+		t.Errorf("expected probing a server without a status endpoint to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types written to the --events stream.
+const (
+	eventSplitQueued    = "split_queued"
+	eventSplitStarted   = "split_started"
+	eventSplitCached    = "split_cached"
+	eventSplitRetried   = "split_retried"
+	eventSplitCompleted = "split_completed"
+	eventSplitFailed    = "split_failed"
+	eventSplitResplit   = "split_resplit"
+	eventSplitFailover  = "split_failover"
+	eventEndpoint       = "endpoint"
+	eventSlotWait       = "slot_wait"
+	eventPOIs           = "pois"
+)
+
+// Provisioning outcomes reported by eventEndpoint.
+const (
+	endpointReady     = "ready"
+	endpointFailed    = "failed"
+	endpointCancelled = "cancelled"
+	endpointUnneeded  = "unneeded"
+)
+
+// runEvent is one entry in the machine-readable event stream. Only the fields
+// relevant to Type are set.
+type runEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Split is 1-based, matching the log output.
+	Split    int    `json:"split,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// eventSplitRetried
+	Attempt int `json:"attempt,omitempty"`
+	// eventSplitResplit: the splits queued in place of Split.
+	Children []int `json:"children,omitempty"`
+	// eventSplitCompleted
+	Cache          string  `json:"cache,omitempty"`
+	QueryBytes     int     `json:"query_bytes,omitempty"`
+	Elements       int     `json:"elements,omitempty"`
+	Nodes          int     `json:"nodes,omitempty"`
+	WayPoints      int     `json:"way_points,omitempty"`
+	ExecuteSeconds float64 `json:"execute_seconds,omitempty"`
+
+	// eventEndpoint
+	Outcome   string `json:"outcome,omitempty"`
+	RateLimit int    `json:"rate_limit,omitempty"`
+	Unlimited bool   `json:"unlimited,omitempty"`
+	Capacity  int    `json:"capacity,omitempty"`
+
+	// eventSlotWait; WaitSeconds is also the split's total slot wait for
+	// eventSplitCompleted.
+	Pending     int     `json:"pending,omitempty"`
+	WaitSeconds float64 `json:"wait_seconds,omitempty"`
+
+	// eventPOIs
+	POIs       int            `json:"pois,omitempty"`
+	Categories map[string]int `json:"categories,omitempty"`
+}
+
+// eventSink receives run events. Sinks are called from many goroutines at
+// once, so must be safe for concurrent use. A nil sink discards events.
+type eventSink func(runEvent)
+
+func (sink eventSink) emit(e runEvent) {
+	if sink == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	sink(e)
+}
+
+// multiSink fans each event out to every non-nil sink.
+func multiSink(sinks ...eventSink) eventSink {
+	var nonNil []eventSink
+	for _, sink := range sinks {
+		if sink != nil {
+			nonNil = append(nonNil, sink)
+		}
+	}
+	if len(nonNil) == 0 {
+		return nil
+	}
+	return func(e runEvent) {
+		for _, sink := range nonNil {
+			sink(e)
+		}
+	}
+}
+
+// jsonLinesSink writes each event to w as a single line of JSON.
+func jsonLinesSink(w io.Writer) eventSink {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(e runEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := encoder.Encode(e); err != nil {
+			slog.Warn("writing event", "err", err)
+		}
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar renders split progress as a single, continually redrawn line.
+// Log lines written to the same terminal will interleave with it; the bar is
+// simply redrawn below them on the next event.
+type progressBar struct {
+	mu      sync.Mutex
+	w       io.Writer
+	total   int
+	done    int
+	failed  int
+	cached  int
+	running int
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w}
+}
+
+func (p *progressBar) sink() eventSink {
+	return func(e runEvent) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		switch e.Type {
+		case eventSplitQueued:
+			p.total++
+		case eventSplitStarted:
+			p.running++
+		case eventSplitCached:
+			p.cached++
+		case eventSplitCompleted:
+			p.running--
+			p.done++
+		case eventSplitFailed:
+			p.running--
+			p.failed++
+		case eventSplitResplit:
+			// Its halves are queued as splits of their own.
+			p.running--
+			p.total--
+		case eventSplitFailover:
+			p.running--
+		case eventPOIs:
+			p.render()
+			_, _ = fmt.Fprintf(p.w, " %d POIs\n", e.POIs)
+			return
+		default:
+			return
+		}
+		p.render()
+	}
+}
+
+func (p *progressBar) render() {
+	const width = 30
+	filled := 0
+	if p.total > 0 {
+		filled = width * (p.done + p.failed) / p.total
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	line := fmt.Sprintf("[%s] %d/%d splits", bar, p.done+p.failed, p.total)
+	if p.running > 0 {
+		line += fmt.Sprintf(", %d running", p.running)
+	}
+	if p.cached > 0 {
+		line += fmt.Sprintf(", %d cached", p.cached)
+	}
+	if p.failed > 0 {
+		line += fmt.Sprintf(", %d failed", p.failed)
+	}
+	// Return to the line start and clear it before redrawing.
+	_, _ = fmt.Fprintf(p.w, "\r\033[K%s", line)
+}
+
+// poiCountsEvent summarises the final POI set by primary category.
+func poiCountsEvent(pois map[string]Point) runEvent {
+	categories := make(map[string]int)
+	for _, p := range pois {
+		categories[p.Category]++
+	}
+	return runEvent{Type: eventPOIs, POIs: len(pois), Categories: categories}
+}
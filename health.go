@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is how many consecutive server or network errors
+	// open an endpoint's circuit.
+	breakerThreshold = 3
+	// breakerProbeInterval is how often an open circuit's endpoint is probed.
+	breakerProbeInterval = 30 * time.Second
+)
+
+// breakerGroup holds the circuit breakers of a run's endpoints. It never opens
+// the circuit of the last endpoint still closed, so units always have
+// somewhere to run and give up through their retry policy rather than waiting
+// forever for an endpoint to recover.
+type breakerGroup struct {
+	mu        sync.Mutex
+	members   []*circuitBreaker
+	threshold int
+	interval  time.Duration
+}
+
+func newBreakerGroup() *breakerGroup {
+	return &breakerGroup{threshold: breakerThreshold, interval: breakerProbeInterval}
+}
+
+// add returns a closed breaker for endpoint name, probed with probe while open.
+func (g *breakerGroup) add(name string, probe func(ctx context.Context) error) *circuitBreaker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b := &circuitBreaker{group: g, name: name, probe: probe}
+	g.members = append(g.members, b)
+	return b
+}
+
+// circuitBreaker takes an endpoint whose requests keep failing out of the
+// pool: while open, the endpoint's workers stop taking units until a probe of
+// its status endpoint succeeds. A nil *circuitBreaker is always closed.
+type circuitBreaker struct {
+	group *breakerGroup
+	name  string
+	probe func(ctx context.Context) error
+
+	// Guarded by group.mu.
+	failures   int
+	open       bool
+	probeAt    time.Time     // when the next probe is due
+	reinstated chan struct{} // closed when the circuit closes again
+}
+
+// record notes the outcome of a request to the endpoint. Only errors worth
+// failing over count against it; any success resets the count.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	g := b.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case err == nil:
+		b.failures = 0
+	case failsOver(err):
+		b.failures++
+		if b.open || b.failures < g.threshold {
+			return
+		}
+		if !slices.ContainsFunc(g.members, func(m *circuitBreaker) bool { return m != b && !m.open }) {
+			slog.Warn("endpoint failing but no other endpoint available, keeping it in the pool", "endpoint", b.name, "failures", b.failures)
+			return
+		}
+		b.open = true
+		b.probeAt = time.Now().Add(g.interval)
+		b.reinstated = make(chan struct{})
+		slog.Warn("endpoint failing, taking it out of the pool until it recovers", "endpoint", b.name, "failures", b.failures, "probe_in", g.interval)
+		metricCircuitOpen.set(1, b.name)
+	}
+}
+
+// isOpen reports whether the endpoint is currently out of the pool.
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.group.mu.Lock()
+	defer b.group.mu.Unlock()
+	return b.open
+}
+
+// wait blocks while the circuit is open, probing the endpoint each interval,
+// and returns once it closes or ctx is done.
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	g := b.group
+	for {
+		g.mu.Lock()
+		if !b.open {
+			g.mu.Unlock()
+			return nil
+		}
+		reinstated := b.reinstated
+		delay := time.Until(b.probeAt)
+		probe := delay <= 0
+		if probe {
+			// Claim this probe; other waiters wait for its outcome.
+			b.probeAt = time.Now().Add(g.interval)
+		}
+		g.mu.Unlock()
+
+		if !probe {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-reinstated:
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		if err := b.probe(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Info("endpoint still failing health probe", "endpoint", b.name, "err", err)
+			continue
+		}
+		g.mu.Lock()
+		if b.open {
+			b.open = false
+			b.failures = 0
+			close(b.reinstated)
+			slog.Info("endpoint passed health probe, returning it to the pool", "endpoint", b.name)
+			metricCircuitOpen.set(0, b.name)
+		}
+		g.mu.Unlock()
+		return nil
+	}
+}
+
+// routeUnit picks which idle worker runs unit, returning its index in idle or
+// -1 to hold the unit back. It prefers an endpoint the unit hasn't failed over
+// from and whose circuit is closed, holding the unit back while such an
+// endpoint exists but is busy. Among those, it takes the endpoint that last
+// fetched the unit's query, else the one with the lowest priority and then the
+// lowest recent latency, but holds the unit back from whichever it takes if
+// that endpoint is degraded while a healthy one could take the unit. Failing
+// all that, any closed endpoint will do, so a unit that has failed everywhere
+// is still retried until its policy gives up.
+func routeUnit(unit workUnit, idle, all []namedClient) int {
+	usable := func(c namedClient) bool {
+		return !c.breaker.isOpen() && !slices.Contains(unit.avoid, c.name)
+	}
+	if slices.ContainsFunc(idle, usable) {
+		best := slices.IndexFunc(idle, func(c namedClient) bool { return usable(c) && c.name == unit.preferred })
+		if best < 0 {
+			var bestLatency time.Duration
+			for i, c := range idle {
+				if !usable(c) {
+					continue
+				}
+				// Endpoints yet to complete a query count as fastest, so
+				// each gets tried.
+				latency, _ := c.score.snapshot()
+				if best < 0 || c.priority < idle[best].priority || (c.priority == idle[best].priority && latency < bestLatency) {
+					best, bestLatency = i, latency
+				}
+			}
+		}
+		slow := degraded(all)
+		if slow[idle[best].name] && slices.ContainsFunc(all, func(c namedClient) bool { return usable(c) && !slow[c.name] }) {
+			return -1
+		}
+		return best
+	}
+	if slices.ContainsFunc(all, usable) {
+		return -1
+	}
+	if i := slices.IndexFunc(idle, func(c namedClient) bool { return !c.breaker.isOpen() }); i >= 0 {
+		return i
+	}
+	if len(idle) > 0 {
+		return 0
+	}
+	return -1
+}
+
+const (
+	// scoreSmoothing is the weight of each new observation in an endpoint's
+	// moving averages.
+	scoreSmoothing = 0.3
+	// slowFactor is how many times slower than the fastest endpoint an
+	// endpoint's recent queries must be for work to be held back from it.
+	slowFactor = 5
+	// maxErrorRate is the recent error rate above which work is held back
+	// from an endpoint.
+	maxErrorRate = 0.5
+	// scoreHalfLife is how long an endpoint's score lasts without an
+	// observation before it fades halfway back to that of an endpoint yet to
+	// be tried.
+	scoreHalfLife = 2 * time.Minute
+)
+
+// endpointScore tracks how an endpoint has performed recently, as moving
+// averages of its query latency and error rate. The averages fade while no
+// queries are observed, so an endpoint that work is held back from comes to
+// look untried again and is given another unit to prove itself with. A nil
+// *endpointScore has no observations.
+type endpointScore struct {
+	mu        sync.Mutex
+	latency   time.Duration // of successful queries; 0 until one is observed
+	errorRate float64
+	observed  time.Time // of the latest query
+}
+
+// faded returns the averages halved for each scoreHalfLife since the latest
+// observation. s.mu must be held.
+func (s *endpointScore) faded(now time.Time) (latency time.Duration, errorRate float64) {
+	if s.observed.IsZero() {
+		return s.latency, s.errorRate
+	}
+	weight := math.Exp2(-math.Floor(float64(now.Sub(s.observed)) / float64(scoreHalfLife)))
+	return time.Duration(weight * float64(s.latency)), weight * s.errorRate
+}
+
+// observe records a query to the endpoint that took d, excluding any wait
+// for a slot, and failed with err. Only errors worth failing over count as
+// errors; the rest say more about the query than the endpoint.
+func (s *endpointScore) observe(d time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.latency, s.errorRate = s.faded(now)
+	s.observed = now
+	failed := 0.0
+	if failsOver(err) {
+		failed = 1
+	}
+	s.errorRate += scoreSmoothing * (failed - s.errorRate)
+	if err != nil {
+		return
+	}
+	if s.latency == 0 {
+		s.latency = d
+		return
+	}
+	s.latency += time.Duration(scoreSmoothing * float64(d-s.latency))
+}
+
+func (s *endpointScore) snapshot() (latency time.Duration, errorRate float64) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faded(time.Now())
+}
+
+// degraded reports which of clients are performing badly enough to hold
+// work back from: those erroring on most queries, or whose queries have
+// recently taken slowFactor times as long as the fastest client's.
+func degraded(clients []namedClient) map[string]bool {
+	var fastest time.Duration
+	for _, c := range clients {
+		if latency, _ := c.score.snapshot(); latency > 0 && (fastest == 0 || latency < fastest) {
+			fastest = latency
+		}
+	}
+	slow := make(map[string]bool)
+	for _, c := range clients {
+		latency, errorRate := c.score.snapshot()
+		if errorRate > maxErrorRate || (fastest > 0 && latency > slowFactor*fastest) {
+			slow[c.name] = true
+		}
+	}
+	return slow
+}
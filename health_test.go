@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	g := newBreakerGroup()
+	g.interval = time.Millisecond
+	probeErr := errors.New("still down")
+	a := g.add("a", func(context.Context) error { return probeErr })
+	b := g.add("b", func(context.Context) error { return nil })
+	serverErr := &httpStatusError{statusCode: http.StatusBadGateway}
+
+	a.record(serverErr)
+	a.record(&httpStatusError{statusCode: http.StatusTooManyRequests})
+	a.record(serverErr)
+	if a.isOpen() {
+		t.Fatal("expected a busy server not to count towards opening the circuit")
+	}
+	a.record(serverErr)
+	if !a.isOpen() {
+		t.Fatalf("expected the circuit to open after %d server errors", g.threshold)
+	}
+
+	for i := 0; i < g.threshold; i++ {
+		b.record(serverErr)
+	}
+	if b.isOpen() {
+		t.Fatal("expected the last closed endpoint to stay in the pool")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := a.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected wait to block while probes fail, got %v", err)
+	}
+	probeErr = nil
+	if err := a.wait(context.Background()); err != nil || a.isOpen() {
+		t.Fatalf("expected a passing probe to close the circuit, got %v", err)
+	}
+}
+
+func Test_routeUnit(t *testing.T) {
+	g := newBreakerGroup()
+	a := namedClient{name: "a", breaker: g.add("a", nil)}
+	b := namedClient{name: "b", breaker: g.add("b", nil)}
+	fresh := workUnit{}
+	failedOnA := workUnit{avoid: []string{"a"}}
+	failedOnBoth := workUnit{avoid: []string{"a", "b"}}
+
+	for _, tc := range []struct {
+		name      string
+		unit      workUnit
+		idle, all []namedClient
+		expected  int
+	}{
+		{name: "first idle", unit: fresh, idle: []namedClient{a, b}, all: []namedClient{a, b}, expected: 0},
+		{name: "avoids failed endpoint", unit: failedOnA, idle: []namedClient{a, b}, all: []namedClient{a, b}, expected: 1},
+		{name: "waits for busy alternative", unit: failedOnA, idle: []namedClient{a}, all: []namedClient{a, b}, expected: -1},
+		{name: "no alternative", unit: failedOnA, idle: []namedClient{a}, all: []namedClient{a}, expected: 0},
+		{name: "failed everywhere", unit: failedOnBoth, idle: []namedClient{b}, all: []namedClient{a, b}, expected: 0},
+		{name: "prefers endpoint with affinity", unit: workUnit{preferred: "b"}, idle: []namedClient{a, b}, all: []namedClient{a, b}, expected: 1},
+		{name: "prefers lower priority", unit: fresh, idle: []namedClient{a, {name: "c", priority: -1}}, all: []namedClient{a, b}, expected: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := routeUnit(tc.unit, tc.idle, tc.all); actual != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_endpointScore(t *testing.T) {
+	var s endpointScore
+	s.observe(10*time.Second, nil)
+	s.observe(20*time.Second, &httpStatusError{statusCode: http.StatusTooManyRequests})
+	if latency, errorRate := s.snapshot(); latency != 10*time.Second || errorRate != 0 {
+		t.Fatalf("expected only successes to count towards latency and busy servers not to count as errors, got %s and %v", latency, errorRate)
+	}
+	s.observe(20*time.Second, nil)
+	if latency, _ := s.snapshot(); latency != 13*time.Second {
+		t.Errorf("expected latency to move 30%% towards the new observation, got %s", latency)
+	}
+	s.observe(0, &httpStatusError{statusCode: http.StatusBadGateway})
+	if _, errorRate := s.snapshot(); errorRate < 0.29 || errorRate > 0.31 {
+		t.Errorf("expected an error rate of 0.3, got %v", errorRate)
+	}
+}
+
+func Test_routeUnit_holdsBackFromSlowEndpoint(t *testing.T) {
+	fast := namedClient{name: "fast", score: &endpointScore{}}
+	slow := namedClient{name: "slow", score: &endpointScore{}}
+	fresh := namedClient{name: "fresh", score: &endpointScore{}}
+	fast.score.observe(time.Second, nil)
+	slow.score.observe(6*time.Second, nil)
+
+	if i := routeUnit(workUnit{}, []namedClient{slow}, []namedClient{fast, slow}); i != -1 {
+		t.Errorf("expected the unit to wait for the fast endpoint, got %d", i)
+	}
+	if i := routeUnit(workUnit{avoid: []string{"fast"}}, []namedClient{slow}, []namedClient{fast, slow}); i != 0 {
+		t.Errorf("expected the slow endpoint to take a unit the fast one failed, got %d", i)
+	}
+	if i := routeUnit(workUnit{}, []namedClient{slow, fast, fresh}, []namedClient{fast, slow, fresh}); i != 2 {
+		t.Errorf("expected an endpoint yet to complete a query to be tried first, got %d", i)
+	}
+}
+
+func Test_routeUnit_holdsBackFromSlowPreferredEndpoint(t *testing.T) {
+	fast := namedClient{name: "fast", score: &endpointScore{}}
+	slow := namedClient{name: "slow", score: &endpointScore{}}
+	fast.score.observe(time.Second, nil)
+	slow.score.observe(6*time.Second, nil)
+
+	if i := routeUnit(workUnit{preferred: "slow"}, []namedClient{slow}, []namedClient{fast, slow}); i != -1 {
+		t.Errorf("expected the unit to wait for the fast endpoint despite its affinity for the slow one, got %d", i)
+	}
+}
+
+func Test_routeUnit_slowEndpointRecovers(t *testing.T) {
+	fast := namedClient{name: "fast", score: &endpointScore{}}
+	slow := namedClient{name: "slow", score: &endpointScore{}}
+	fast.score.observe(time.Second, nil)
+	slow.score.observe(6*time.Second, nil)
+	if i := routeUnit(workUnit{}, []namedClient{slow}, []namedClient{fast, slow}); i != -1 {
+		t.Fatalf("expected the unit to wait for the fast endpoint, got %d", i)
+	}
+
+	// Work held back from the slow endpoint leaves its score to fade.
+	slow.score.observed = slow.score.observed.Add(-scoreHalfLife)
+	if i := routeUnit(workUnit{}, []namedClient{slow}, []namedClient{fast, slow}); i != 0 {
+		t.Fatalf("expected the slow endpoint to be tried again once its score faded, got %d", i)
+	}
+	slow.score.observe(time.Second, nil)
+	if slow := degraded([]namedClient{fast, slow}); len(slow) > 0 {
+		t.Errorf("expected a fast query to return the endpoint to health, got degraded %v", slow)
+	}
+}
+
+func Test_endpointScore_fades(t *testing.T) {
+	var s endpointScore
+	s.observe(10*time.Second, &httpStatusError{statusCode: http.StatusBadGateway})
+	s.observe(10*time.Second, nil)
+	latency, errorRate := s.snapshot()
+	s.observed = s.observed.Add(-2 * scoreHalfLife)
+	if l, e := s.snapshot(); l != latency/4 || e != errorRate/4 {
+		t.Errorf("expected the score to halve for each half-life without observations, got %s and %v from %s and %v", l, e, latency, errorRate)
+	}
+}
@@ -10,10 +10,9 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"maps"
 	"math"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -30,10 +29,6 @@ import (
 	"golang.org/x/text/language"
 )
 
-const (
-	debug = false
-)
-
 const (
 	// TODO(glynternet): workout better API
 	ExistsUndefined = iota
@@ -43,6 +38,11 @@ const (
 
 type query struct {
 	radius int
+	// compact marks categories whose features are small enough that their
+	// centre stands in for them, like shops and cafés in buildings. With
+	// querySettings.compact they are fetched with `out center` rather than
+	// full geometry.
+	compact bool
 	// conditions are AND'd when rendered as a query
 	conditions []condition
 }
@@ -57,7 +57,19 @@ type condition struct {
 // API
 
 type response struct {
+	OSM3S    osm3s     `json:"osm3s"`
 	Elements []element `json:"elements"`
+	// Remark carries runtime errors (and informational notes) Overpass reports
+	// despite responding HTTP 200; see parseRemark.
+	Remark string `json:"remark,omitempty"`
+}
+
+// osm3s is the metadata Overpass attaches to every response. TimestampOSMBase is
+// the point in time the result reflects, and is where an incremental update of a
+// cached result diffs from.
+type osm3s struct {
+	TimestampOSMBase string `json:"timestamp_osm_base"`
+	Copyright        string `json:"copyright,omitempty"`
 }
 
 type element struct {
@@ -69,6 +81,9 @@ type element struct {
 	Tags     map[string]string `json:"tags"`
 	Geometry []LatLon          `json:"geometry"`
 	Members  []member          `json:"members"`
+	// Center is set instead of Geometry for ways and relations queried with
+	// `out center`.
+	Center *LatLon `json:"center,omitempty"`
 }
 
 type member struct {
@@ -173,6 +188,15 @@ type workUnit struct {
 	splitIndex  int
 	queries     []query
 	routePoints []gpxgo.GPXPoint
+	// retry is the unit's retry progress so far, carried over when it fails
+	// over to another endpoint.
+	retry retryState
+	// avoid names the endpoints the unit has failed over from, which it is
+	// only routed back to when no other endpoint is available.
+	avoid []string
+	// preferred names the endpoint that last fetched the unit's query, if
+	// known.
+	preferred string
 }
 
 // workResult contains the results from processing a single split.
@@ -180,15 +204,83 @@ type workResult struct {
 	splitIndex int
 	nodes      []element
 	wayPoints  []wayPoint
+	// changes lists the elements an incremental cache update found to have been
+	// added, modified or deleted since the split was last queried.
+	changes []elementChange
+	// costs is what each of the unit's category groups cost to query, for
+	// planning future runs.
+	costs map[string]categoryCost
+	// endpoint fetched the split's query, keyed in the cache by queryKey.
+	// Both are empty when the query was served from the cache.
+	endpoint string
+	queryKey string
+}
+
+// cacheConfig holds the settings governing the on-disk query cache.
+type cacheConfig struct {
+	dir string
+	ttl time.Duration
+	// incremental refreshes expired entries by applying an Overpass augmented
+	// diff since the cached result's timestamp_osm_base, rather than
+	// re-downloading the whole result.
+	incremental bool
+	// shareSlots shares each Overpass server's slots with the other
+	// processes on the host sharing the cache dir.
+	shareSlots bool
 }
 
-// endpointSpec describes one Overpass server configured via --overpass-endpoint.
-// Concurrency is only consulted when the server reports Rate limit: 0 (unlimited).
+// sharedSlotsDir returns the directory to share servers' slots through, or ""
+// if they aren't shared.
+func (c cacheConfig) sharedSlotsDir() string {
+	if !c.shareSlots {
+		return ""
+	}
+	return filepath.Join(c.dir, sharedSlotsDir)
+}
+
+// queryOutcome is what a rendered query resolved to, either from the cache or
+// the API.
+type queryOutcome struct {
+	elements []element
+	// changes is non-empty only when an expired cache entry was refreshed
+	// incrementally.
+	changes []elementChange
+	// cache is how the cache served the query: cacheHit, cacheMiss,
+	// cacheExpired or cacheUpdated.
+	cache string
+}
+
+const (
+	cacheHit     = "hit"
+	cacheMiss    = "miss"
+	cacheExpired = "expired" // re-downloaded in full
+	cacheUpdated = "updated" // refreshed incrementally
+)
+
+// endpointSpec describes one Overpass server configured via --overpass-endpoint
+// or --endpoints-config. Concurrency is only consulted when the server reports
+// Rate limit: 0 (unlimited).
 type endpointSpec struct {
-	Name        string
-	Interpreter string
-	Status      string
-	Concurrency int // used only for unlimited servers; 0 means use default
+	Name        string `yaml:"name"`
+	Interpreter string `yaml:"interpreter"`
+	Status      string `yaml:"status"`
+	Concurrency int    `yaml:"concurrency"` // used only for unlimited servers; 0 means use default
+	// Slots is the fixed number of concurrent queries for a server with no
+	// status endpoint; when set, Status is never fetched.
+	Slots int `yaml:"slots"`
+	// Timeout overrides --http-timeout for this server when non-zero.
+	Timeout time.Duration `yaml:"timeout"`
+	// Headers are sent with every request, e.g. for a private instance behind
+	// an authenticating proxy.
+	Headers map[string]string `yaml:"headers"`
+	// Priority orders servers by preference: units go to the lowest priority
+	// server free to take them.
+	Priority int `yaml:"priority"`
+	// UserAgent overrides the default User-Agent.
+	UserAgent string `yaml:"user_agent"`
+	// RatePerMinute paces the queries of a server with fixed Slots; 0 paces
+	// them only by its slots and backoff on 429.
+	RatePerMinute float64 `yaml:"rate_per_minute"`
 }
 
 // endpointFlag implements flag.Value for repeatable --overpass-endpoint.
@@ -251,105 +343,127 @@ func defaultEndpoints() []endpointSpec {
 type namedClient struct {
 	name   string
 	client *overpass.Client
+	// breaker takes the endpoint out of the pool while it is failing; nil
+	// never does.
+	breaker *circuitBreaker
+	// score tracks the endpoint's recent performance, for routing units.
+	score *endpointScore
+	// priority orders endpoints by preference, lowest first.
+	priority int
+	// workers is the global --workers semaphore, set by the worker pool;
+	// nil when uncapped.
+	workers chan struct{}
+	// traffic records or replays the client's queries; nil for neither.
+	traffic trafficTap
 }
 
-// clientWorkers binds a named client to its capacity: the number of worker
-// goroutines (concurrent query slots) it offers, which pull from the shared jobs
-// channel and run queries through it. For rate-limited servers this is the rate
-// limit; for unlimited servers it is the configured concurrency.
-type clientWorkers struct {
-	client   namedClient
-	capacity int
-}
-
-// retryConfig holds retry settings
-type retryConfig struct {
-	maxRetries int
-	baseDelay  time.Duration
-	maxDelay   time.Duration
+// throttles reports whether the client holds back its next request after a
+// 429 by itself. A client sending to an unlimited server doesn't.
+func (c namedClient) throttles() bool {
+	return c.client != nil && !c.client.Unlimited()
 }
 
-// httpStatusError wraps HTTP status code errors for retry logic
-type httpStatusError struct {
-	statusCode int
-	status     string
+// admit waits for a global --workers slot, returning a func to give it back.
+// It returns at once when uncapped.
+func (c namedClient) admit(ctx context.Context) (release func(), err error) {
+	if c.workers == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.workers <- struct{}{}:
+		return func() { <-c.workers }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-func (e *httpStatusError) Error() string {
-	return fmt.Sprintf("unexpected status code %d (%s)", e.statusCode, e.status)
+// query posts query to the client's server, through its traffic tap if it has
+// one.
+func (c namedClient) query(ctx context.Context, query string) (*http.Response, error) {
+	if c.traffic != nil {
+		return c.traffic.query(ctx, c.name, query, c.send)
+	}
+	return c.send(ctx, query)
 }
 
-// isRetryableError determines if an error should trigger a retry
-func isRetryableError(err error) bool {
-	// Network errors are retryable
-	var netErr net.Error
-	if errors.As(err, &netErr) {
-		return true
+// send posts query to the client's server once the server has granted a slot
+// for it and a global --workers slot is free, so --workers counts only
+// queries that are running rather than waiting out a cooldown. Both slots are
+// held until the response body is closed.
+func (c namedClient) send(ctx context.Context, query string) (*http.Response, error) {
+	slot, err := c.client.Acquire(ctx)
+	if err != nil {
+		return nil, err
 	}
-
-	// Check for HTTP status code errors
-	var httpErr *httpStatusError
-	if errors.As(err, &httpErr) {
-		return httpErr.statusCode >= 500 || httpErr.statusCode == 429
+	admitted, err := c.admit(ctx)
+	if err != nil {
+		slot.Release()
+		return nil, err
 	}
-
-	return false
+	release := func() {
+		admitted()
+		slot.Release()
+	}
+	resp, err := slot.Do(query)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = overpass.ReleaseOnClose(resp.Body, release)
+	return resp, nil
 }
 
-func retrier[T any](conf retryConfig) func(ctx context.Context, queryFn func() (T, error)) (T, error) {
-	return func(ctx context.Context, queryFn func() (T, error)) (T, error) {
-		var result T
-		var lastErr error
-
-		for attempt := 0; attempt <= conf.maxRetries; attempt++ {
-			if attempt > 0 {
-				delay := conf.baseDelay * time.Duration(1<<(attempt-1))
-				if delay > conf.maxDelay {
-					delay = conf.maxDelay
-				}
-
-				select {
-				case <-ctx.Done():
-					return result, ctx.Err()
-				case <-time.After(delay):
-				}
-
-				log.Printf("Retry attempt %d/%d after error: %v", attempt, conf.maxRetries, lastErr)
-			}
-
-			result, lastErr = queryFn()
-			if lastErr == nil {
-				return result, nil
-			}
+// clientWorkers binds a named client to its capacity: the number of worker
+// goroutines (concurrent query slots) it offers, which pull from the shared jobs
+// channel and run queries through it. For rate-limited servers this is the rate
+// limit; for unlimited servers it is the configured concurrency.
+type clientWorkers struct {
+	client   namedClient
+	capacity int
+}
 
-			// Only retry on transient errors
-			if !isRetryableError(lastErr) {
-				return result, lastErr
-			}
-		}
+// requeueError is returned by a concurrentUnitsWorker processUnit function to
+// replace the unit it was given with units, which are queued behind the
+// existing work rather than reported as a result or error.
+type requeueError[Unit any] struct {
+	units []Unit
+	cause error
+}
 
-		return result, fmt.Errorf("max retries (%d) exceeded: %w", conf.maxRetries, lastErr)
-	}
+func (e *requeueError[Unit]) Error() string {
+	return fmt.Sprintf("requeueing as %d units: %v", len(e.units), e.cause)
 }
 
+func (e *requeueError[Unit]) Unwrap() error { return e.cause }
+
 // concurrentUnitsWorker returns a function that processes units concurrently
 // using a pool of workers. The processUnit function is called for each unit.
 // If failFast is true, processing stops on the first error.
 // If failFast is false, all errors are collected and returned joined.
+// processUnit may instead return a *requeueError to replace its unit with
+// others, e.g. smaller pieces of it; the pool keeps running until every unit,
+// including requeued ones, has a result or error.
 //
 // clientsReady streams clients as each finishes provisioning, so workers begin
 // draining the queue the moment their client is ready rather than waiting for
 // every client to provision. The channel must be closed once no more clients
 // will arrive. Each client contributes `capacity` worker goroutines that pull
-// from the shared jobs queue, so per-client concurrency never exceeds that
-// server's limit and work naturally flows to whichever server has a free worker.
+// from the shared queue, so per-client concurrency never exceeds that server's
+// limit and work naturally flows to whichever server has a free worker. A
+// client's workers take no units while its circuit breaker is open.
+//
+// route, when non-nil, chooses which idle worker takes a queued unit, given
+// the clients of the idle workers and of every worker seen so far; it returns
+// an index into idle, or -1 to hold the unit back until another worker is
+// idle. When nil, the first idle worker takes the oldest unit.
 //
-// workers, when > 0, is a global concurrency cap enforced by a shared semaphore:
-// at most `workers` units run at once across all servers. When 0 there is no
-// extra cap and concurrency is just the sum of the servers' capacities. A worker
-// only takes a semaphore slot once it already holds a unit on its client (the
-// client space is acquired first), so a scarce global slot is never parked while
-// waiting for a free server.
+// workers, when non-nil, is a global concurrency cap from newWorkerCap, which
+// may be shared with other pools: at most cap(workers) queries run at once
+// across all servers. When nil there is no extra cap and concurrency is just
+// the sum of the servers' capacities. The semaphore is handed to processUnit
+// as the client's workers, to take with
+// admit only once its server has granted a slot (see namedClient.query), so a
+// scarce global slot is never parked while waiting out a server's cooldown.
 //
 // ctx/cancel are shared with client provisioning: cancel is called once all
 // units are processed (or on failFast), which aborts still-in-flight queries,
@@ -360,12 +474,14 @@ func concurrentUnitsWorker[Unit any, Result any](
 	cancel context.CancelFunc,
 	clientsReady <-chan clientWorkers,
 	processUnit func(client namedClient, unit Unit) (Result, error),
+	route func(unit Unit, idle, all []namedClient) int,
 	failFast bool,
-	workers int,
+	workers chan struct{},
 ) func(units ...Unit) ([]Result, error) {
 	type resultOrError struct {
-		result Result
-		err    error
+		result  Result
+		err     error
+		requeue []Unit
 	}
 
 	return func(units ...Unit) ([]Result, error) {
@@ -376,20 +492,59 @@ func concurrentUnitsWorker[Unit any, Result any](
 			return nil, nil
 		}
 
-		// The full set of work is known up front, so pre-fill and close the
-		// queue. Workers that attach later simply drain the buffered channel.
-		jobs := make(chan Unit, len(units))
-		for _, unit := range units {
-			jobs <- unit
-		}
-		close(jobs)
-
-		// Global concurrency cap. nil when uncapped (workers == 0), in which
-		// case the sum of client capacities is the only limit.
-		var sem chan struct{}
-		if workers > 0 {
-			sem = make(chan struct{}, workers)
+		// The dispatcher hands queued units to idle workers, taking requeued
+		// units onto the back of the queue. Requeues mean the amount of work
+		// isn't known up front, so it runs until ctx is cancelled, which
+		// happens once every unit has a result (or on failFast).
+		type workRequest struct {
+			client namedClient
+			unit   chan Unit // buffered, so the dispatcher never blocks
 		}
+		requests := make(chan workRequest)
+		requeue := make(chan []Unit)
+		go func() {
+			queue := slices.Clone(units)
+			var idle []workRequest
+			var all []namedClient
+			for {
+				for i := 0; i < len(queue) && len(idle) > 0; {
+					j := 0
+					if route != nil {
+						idleClients := make([]namedClient, len(idle))
+						for k, req := range idle {
+							idleClients[k] = req.client
+						}
+						j = route(queue[i], idleClients, all)
+					}
+					if j < 0 {
+						i++
+						continue
+					}
+					idle[j].unit <- queue[i]
+					idle = slices.Delete(idle, j, j+1)
+					queue = slices.Delete(queue, i, i+1)
+				}
+				// A held-back unit may become routable without any worker
+				// asking for work, e.g. when a circuit breaker changes state,
+				// so look again shortly.
+				var recheck <-chan time.Time
+				if len(queue) > 0 && len(idle) > 0 {
+					recheck = time.After(time.Second)
+				}
+				select {
+				case req := <-requests:
+					idle = append(idle, req)
+					if !slices.ContainsFunc(all, func(c namedClient) bool { return c.name == req.client.name }) {
+						all = append(all, req.client)
+					}
+				case requeued := <-requeue:
+					queue = append(queue, requeued...)
+				case <-recheck:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
 
 		results := make(chan resultOrError)
 
@@ -404,29 +559,33 @@ func concurrentUnitsWorker[Unit any, Result any](
 					workerWg.Add(1)
 					go func(c namedClient) {
 						defer workerWg.Done()
-						for unit := range jobs {
+						c.workers = workers
+						for {
+							if err := c.breaker.wait(ctx); err != nil {
+								return
+							}
+							req := workRequest{client: c, unit: make(chan Unit, 1)}
 							select {
+							case requests <- req:
 							case <-ctx.Done():
 								return
-							default:
 							}
-							// Client space is already held (this goroutine);
-							// now take a global slot before doing the work.
-							if sem != nil {
-								select {
-								case <-ctx.Done():
-									return
-								case sem <- struct{}{}:
-								}
+							var unit Unit
+							select {
+							case unit = <-req.unit:
+							case <-ctx.Done():
+								return
 							}
 							result, err := processUnit(c, unit)
-							if sem != nil {
-								<-sem
+							r := resultOrError{result: result, err: err}
+							var requeueErr *requeueError[Unit]
+							if errors.As(err, &requeueErr) {
+								r = resultOrError{requeue: requeueErr.units}
 							}
 							select {
 							case <-ctx.Done():
 								return
-							case results <- resultOrError{result, err}:
+							case results <- r:
 							}
 						}
 					}(cw.client)
@@ -444,11 +603,18 @@ func concurrentUnitsWorker[Unit any, Result any](
 		var allResults []Result
 		var errs []error
 		var firstErr error
-		received := 0
+		outstanding := len(units)
 
 		for r := range results {
-			received++
-			if r.err != nil {
+			outstanding--
+			switch {
+			case r.requeue != nil:
+				outstanding += len(r.requeue)
+				select {
+				case requeue <- r.requeue:
+				case <-ctx.Done():
+				}
+			case r.err != nil:
 				if !failFast {
 					errs = append(errs, r.err)
 				} else if firstErr == nil {
@@ -456,18 +622,21 @@ func concurrentUnitsWorker[Unit any, Result any](
 					cancel()
 					// Continue draining to allow workers to finish
 				}
-			} else {
+			default:
 				allResults = append(allResults, r.result)
 			}
 			// Once every unit has a result, no client is still needed. Cancel so
 			// a slow server's in-flight status fetch aborts rather than blocking
 			// our return; without this, results stays open until every
 			// provisioning attempt (including the slow one) completes.
-			if received == len(units) {
-				log.Printf("All %d units processed; cancelling any in-flight provisioning and shutting down", len(units))
+			if outstanding == 0 {
+				slog.Info("all units processed; cancelling any in-flight provisioning and shutting down", "units", len(allResults)+len(errs))
 				cancel()
 			}
 		}
+		// results can also close with work outstanding, when no client was
+		// ever provisioned; stop the dispatcher.
+		cancel()
 
 		if firstErr != nil {
 			return allResults, firstErr
@@ -476,64 +645,360 @@ func concurrentUnitsWorker[Unit any, Result any](
 	}
 }
 
-// unitProcessor returns a function that processes a single split by building
-// a consolidated Overpass union query across all categories, executing it via
-// queryResponseElementsRaw, and separating nodes from ways in the response.
+// newWorkerCap returns the semaphore capping concurrent queries at workers, the
+// --workers flag, or nil when workers is 0 for no cap.
+func newWorkerCap(workers int) chan struct{} {
+	if workers == 0 {
+		return nil
+	}
+	return make(chan struct{}, workers)
+}
+
+// unitProcessor returns a function that processes a single split with
+// processWorkUnit, reporting the split's progress to events. With a resplitter,
+// a split the server runs out of time or memory on is requeued as two halves
+// instead of being retried. A split that fails over is requeued as is, to be
+// retried on whichever endpoint is free next.
 func unitProcessor(
 	ctx context.Context,
-	cacheDir string,
-	cacheTTL time.Duration,
-	queryElementsWithRetry func(ctx context.Context, queryFn func() ([]element, error)) ([]element, error),
-	queryTimeout time.Duration,
+	cache cacheConfig,
+	queryElementsWithRetry func(ctx context.Context, state *retryState, queryFn func() (queryOutcome, error)) (queryOutcome, error),
+	settings querySettings,
+	resplit *resplitter,
+	events eventSink,
 ) func(c namedClient, unit workUnit) (workResult, error) {
 	return func(c namedClient, unit workUnit) (workResult, error) {
-		log.Printf("Worker [%s] processing split %d", c.name, unit.splitIndex+1)
-
-		renderedQuery, err := renderUnionQuery(unit.queries, unit.routePoints, queryTimeout)
-		if err != nil {
-			return workResult{}, fmt.Errorf("split %d: rendering union query: %w", unit.splitIndex+1, err)
+		halves := resplit.bisect(unit)
+		result, err := processWorkUnit(ctx, cache, queryElementsWithRetry, settings, halves != nil, events, c, unit)
+		var resplitErr *resplitError
+		if errors.As(err, &resplitErr) {
+			halves = resplit.number(halves)
+			children := make([]int, len(halves))
+			for i, h := range halves {
+				children[i] = h.splitIndex + 1
+			}
+			slog.Warn("query too expensive for server, requeueing split as halves",
+				"split", unit.splitIndex+1, "endpoint", c.name, "points", len(unit.routePoints), "children", children, "remark", resplitErr.cause.remark)
+			events.emit(runEvent{Type: eventSplitResplit, Split: unit.splitIndex + 1, Endpoint: c.name, Children: children, Error: resplitErr.cause.remark})
+			for _, child := range children {
+				events.emit(runEvent{Type: eventSplitQueued, Split: child})
+			}
+			return workResult{}, &requeueError[workUnit]{units: halves, cause: err}
 		}
-
-		elements, err := queryElementsWithRetry(ctx, func() ([]element, error) {
-			return queryResponseElementsRaw(ctx, cacheDir, cacheTTL, c.client.Query, renderedQuery)
-		})
-		if err != nil {
-			return workResult{}, fmt.Errorf("split %d [%s]: querying elements: %w", unit.splitIndex+1, c.name, err)
-		}
-
-		var nodeElements []element
-		var wps []wayPoint
-		for _, e := range elements {
-			switch e.Type {
-			case "node":
-				nodeElements = append(nodeElements, e)
-			case "way":
-				wps = append(wps, processWayElement(e, unit.routePoints)...)
-			case "relation":
-				wps = append(wps, processRelationElement(e, unit.routePoints)...)
+		var failoverErr *failoverError
+		if errors.As(err, &failoverErr) {
+			slog.Warn("endpoint failing, requeueing split for another endpoint",
+				"split", unit.splitIndex+1, "endpoint", c.name, "attempts", failoverErr.state.attempts, "err", failoverErr.state.lastErr)
+			events.emit(runEvent{Type: eventSplitFailover, Split: unit.splitIndex + 1, Endpoint: c.name, Error: failoverErr.state.lastErr.Error()})
+			unit.retry = failoverErr.state
+			if !slices.Contains(unit.avoid, c.name) {
+				unit.avoid = append(slices.Clone(unit.avoid), c.name)
 			}
+			return workResult{}, &requeueError[workUnit]{units: []workUnit{unit}, cause: err}
 		}
+		if err != nil {
+			events.emit(runEvent{Type: eventSplitFailed, Split: unit.splitIndex + 1, Endpoint: c.name, Error: err.Error()})
+		}
+		return result, err
+	}
+}
 
-		log.Printf("Split %d: %d nodes, %d way points", unit.splitIndex+1, len(nodeElements), len(wps))
+// processWorkUnit builds a consolidated Overpass union query across all of the
+// unit's categories, executes it via queryResponseElementsRaw, and separates
+// nodes from ways in the response. With resplit, a query the server runs out
+// of time or memory on fails at once with a *resplitError rather than being
+// retried.
+func processWorkUnit(
+	ctx context.Context,
+	cache cacheConfig,
+	queryElementsWithRetry func(ctx context.Context, state *retryState, queryFn func() (queryOutcome, error)) (queryOutcome, error),
+	settings querySettings,
+	resplit bool,
+	events eventSink,
+	c namedClient,
+	unit workUnit,
+) (workResult, error) {
+	slog.Info("processing split", "endpoint", c.name, "split", unit.splitIndex+1)
+	events.emit(runEvent{Type: eventSplitStarted, Split: unit.splitIndex + 1, Endpoint: c.name})
+
+	renderedQuery, err := renderUnionQuery(unit.queries, unit.routePoints, settings)
+	if err != nil {
+		return workResult{}, fmt.Errorf("split %d: rendering union query: %w", unit.splitIndex+1, err)
+	}
 
-		return workResult{
-			splitIndex: unit.splitIndex,
-			nodes:      nodeElements,
-			wayPoints:  wps,
-		}, nil
+	// Time spent across all attempts waiting for a slot, and executing the
+	// query (everything else an attempt does). Backoff between attempts is in
+	// neither.
+	var waited, executed time.Duration
+	traceCtx := overpass.WithTrace(ctx, &overpass.Trace{
+		SlotGranted: func(d time.Duration) { waited += d },
+	})
+	// A retry has already waited its turn, so it queues for a slot ahead of
+	// fresh work.
+	retryCtx := overpass.WithPriority(traceCtx, overpass.ContextPriority(ctx).Raised())
+	state := unit.retry
+	outcome, err := queryElementsWithRetry(ctx, &state, func() (queryOutcome, error) {
+		attemptCtx := traceCtx
+		if state.attempts > 0 {
+			events.emit(runEvent{Type: eventSplitRetried, Split: unit.splitIndex + 1, Endpoint: c.name, Attempt: state.attempts})
+			attemptCtx = retryCtx
+		}
+		start, waitedBefore := time.Now(), waited
+		outcome, err := queryResponseElementsRaw(attemptCtx, cache, c.query, renderedQuery)
+		took := time.Since(start) - (waited - waitedBefore)
+		var httpErr *httpStatusError
+		if errors.As(err, &httpErr) && httpErr.statusCode == http.StatusTooManyRequests {
+			httpErr.throttled = c.throttles()
+		}
+		executed += took
+		// A cache hit says nothing about the endpoint's health.
+		if ctx.Err() == nil && outcome.cache != cacheHit {
+			c.breaker.record(err)
+			c.score.observe(took, err)
+		}
+		var remarkErr *remarkError
+		if resplit && errors.As(err, &remarkErr) && remarkErr.resourceExhausted() {
+			return outcome, &resplitError{cause: remarkErr}
+		}
+		return outcome, err
+	})
+	if err != nil {
+		return workResult{}, fmt.Errorf("split %d [%s]: querying elements: %w", unit.splitIndex+1, c.name, err)
+	}
+	var endpoint, queryKey string
+	if outcome.cache == cacheHit {
+		events.emit(runEvent{Type: eventSplitCached, Split: unit.splitIndex + 1, Endpoint: c.name})
+	} else {
+		endpoint, queryKey = c.name, cacheKey(renderedQuery)
+	}
+
+	var nodeElements []element
+	var wps []wayPoint
+	for _, e := range outcome.elements {
+		switch e.Type {
+		case "node":
+			nodeElements = append(nodeElements, e)
+		case "way":
+			wps = append(wps, processWayElement(e, unit.routePoints)...)
+		case "relation":
+			wps = append(wps, processRelationElement(e, unit.routePoints)...)
+		}
 	}
+
+	slog.Info("split processed", "split", unit.splitIndex+1, "nodes", len(nodeElements), "way_points", len(wps))
+	events.emit(runEvent{
+		Type:           eventSplitCompleted,
+		Split:          unit.splitIndex + 1,
+		Endpoint:       c.name,
+		Cache:          outcome.cache,
+		QueryBytes:     len(renderedQuery),
+		Elements:       len(outcome.elements),
+		Nodes:          len(nodeElements),
+		WayPoints:      len(wps),
+		WaitSeconds:    waited.Seconds(),
+		ExecuteSeconds: executed.Seconds(),
+	})
+
+	return workResult{
+		splitIndex: unit.splitIndex,
+		nodes:      nodeElements,
+		wayPoints:  wps,
+		changes:    outcome.changes,
+		costs:      unitCosts(unit, outcome.elements),
+		endpoint:   endpoint,
+		queryKey:   queryKey,
+	}, nil
 }
 
 func main() {
-	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
+	if len(os.Args) > 1 {
+		var subcommand func(args []string) error
+		switch os.Args[1] {
+		case "diff":
+			subcommand = diffMain
+		case "serve":
+			subcommand = serveMain
+		}
+		if subcommand != nil {
+			if err := subcommand(os.Args[2:]); err != nil {
+				slog.Error("failed", "err", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
 	// flags have to go before args
 	// TODO(glynternet): use better flags package
 	namePrefix := flag.String(`name-prefix`, ``, `prefix to place in front of all points`)
 	split := flag.Uint(`split`, 5, `number of segments to split track into for querying overpass API`)
 	out := flag.String(`out`, "-", `file to write output to, "-" writes to stdout`)
-	workers := flag.Int(`workers`, 0, `number of concurrent workers for API requests (0=auto-detect from API rate limit)`)
-	retries := flag.Int(`retries`, 5, `number of retries per API request on transient failures`)
 	failFast := flag.Bool(`fail-fast`, true, `stop processing on first API error`)
+	eventsFile := flag.String(`events`, ``, `file to write a JSON lines stream of run events to (split progress, endpoint provisioning, slot waits and final POI counts)`)
+	progress := flag.Bool(`progress`, true, `show a progress bar on stderr when it is a terminal`)
+	plan := flag.Bool(`plan`, false, `query category groups that previous runs found expensive (e.g. long waterways) separately, on shorter route segments than the rest`)
+	planBudget := flag.Float64(`plan-budget`, 100000, `estimated cost (elements plus geometry points) a --plan query should stay within`)
+	reportFile := flag.String(`report`, ``, `file to write a JSON run report to (per-split and per-endpoint statistics); the report is also printed to stderr as a table`)
+	recordDir := flag.String(`record`, ``, `directory to record every Overpass query, response and status body to, with timings, for --replay; queries answered from the cache are not recorded, so record with an empty --cache-dir to capture a whole run`)
+	replayDir := flag.String(`replay`, ``, `directory recorded by --record to serve Overpass queries and statuses from, without network access; use an empty --cache-dir so every query is replayed`)
+	lf := registerLogFlags(flag.CommandLine)
+	pf := registerPipelineFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := lf.setDefault(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if err := pf.validate(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+	if len(args) != 1 {
+		slog.Error("must provide gpx file arg")
+		os.Exit(1)
+	}
+	var traffic trafficTap
+	var recorder *trafficRecorder
+	switch {
+	case *recordDir != "" && *replayDir != "":
+		slog.Error("--record cannot be combined with --replay")
+		os.Exit(1)
+	case *recordDir != "":
+		r, err := newTrafficRecorder(*recordDir)
+		if err != nil {
+			slog.Error("starting recording", "err", err)
+			os.Exit(1)
+		}
+		traffic, recorder = r, r
+	case *replayDir != "":
+		r, err := loadTrafficReplay(*replayDir)
+		if err != nil {
+			slog.Error("loading recording", "err", err)
+			os.Exit(1)
+		}
+		traffic = r
+	}
+	if *pf.metricsAddr != "" {
+		serveMetrics(*pf.metricsAddr)
+	}
+
+	var sinks []eventSink
+	var eventsOut *os.File
+	if *eventsFile != "" {
+		f, err := os.Create(*eventsFile)
+		if err != nil {
+			slog.Error("creating events file", "err", err)
+			os.Exit(1)
+		}
+		eventsOut = f
+		sinks = append(sinks, jsonLinesSink(f))
+	}
+	if *progress && isTerminal(os.Stderr) {
+		sinks = append(sinks, newProgressBar(os.Stderr).sink())
+	}
+	var reporter *reportBuilder
+	if *reportFile != "" {
+		reporter = newReportBuilder()
+		sinks = append(sinks, reporter.sink())
+	}
+
+	config := pf.runConfig()
+	config.namePrefix = *namePrefix
+	config.split = *split
+	config.failFast = *failFast
+	if *plan {
+		config.planBudget = *planBudget
+	}
+	err := mainErr(args[0], *out, config, traffic, multiSink(sinks...))
+	metrics.logSummary()
+	if reporter != nil {
+		report := reporter.report()
+		if tableErr := writeReportTable(os.Stderr, report); tableErr != nil {
+			slog.Warn("printing run report", "err", tableErr)
+		}
+		if reportErr := writeReportFile(*reportFile, report); reportErr != nil && err == nil {
+			err = reportErr
+		}
+	}
+	if eventsOut != nil {
+		if closeErr := eventsOut.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("closing events file: %w", closeErr)
+		}
+	}
+	if recorder != nil {
+		if closeErr := recorder.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		slog.Error("failed", "err", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// logFlags configure the process-wide logger. Every command registers them.
+type logFlags struct {
+	level  *string
+	format *string
+}
+
+func registerLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		level:  fs.String(`log-level`, `info`, `minimum level to log: debug, info, warn or error`),
+		format: fs.String(`log-format`, `text`, `log output format: text or json`),
+	}
+}
+
+// setDefault installs the logger described by the flags as the slog default,
+// writing to stderr. Output from the standard log package is routed through it
+// too. It must be called after the flag set has been parsed.
+func (lf *logFlags) setDefault() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*lf.level)); err != nil {
+		return fmt.Errorf("invalid --log-level %q: %w", *lf.level, err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch *lf.format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid --log-format %q: must be text or json", *lf.format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// pipelineFlags are the flags configuring how routes are queried, shared by the
+// default command and the `serve` subcommand.
+type pipelineFlags struct {
+	workers         *int
+	retries         *int
+	retryMaxElapsed *time.Duration
+	failover        *bool
+	cacheDir        *string
+	cacheTTL        *time.Duration
+	incremental     *bool
+	shareSlots      *bool
+	settings        querySettings
+	httpTimeoutFlag *time.Duration
+	resplit         *bool
+	minSplitPoints  *int
+	metricsAddr     *string
+	endpointsConfig *string
+	endpoints       endpointFlag
+}
+
+func registerPipelineFlags(fs *flag.FlagSet) *pipelineFlags {
+	var pf pipelineFlags
+	pf.workers = fs.Int(`workers`, 0, `number of concurrent workers for API requests (0=auto-detect from API rate limit)`)
+	pf.retries = fs.Int(`retries`, 5, `number of retries per API request on transient failures`)
+	pf.retryMaxElapsed = fs.Duration(`retry-max-elapsed`, 15*time.Minute, `stop retrying a split once this long has passed since its first attempt (0 = no limit)`)
+	pf.failover = fs.Bool(`failover`, true, `with several endpoints, retry a split that hits a server or network error on whichever endpoint is free next rather than backing off on the same one`)
 
 	var defaultCacheDir string
 	if homeDir, err := os.UserHomeDir(); err != nil {
@@ -542,35 +1007,146 @@ func main() {
 	} else {
 		defaultCacheDir = filepath.Join(homeDir, `.route-poi-finder-state`)
 	}
-	cacheDir := flag.String(`cache-dir`, defaultCacheDir, `directory to cache results in`)
-	cacheTTL := flag.Duration(`cache-ttl`, 28*24*time.Hour, `maximum age of cached API responses before re-querying`)
-	var endpoints endpointFlag
-	flag.Var(&endpoints, `overpass-endpoint`, `Overpass server as NAME=INTERPRETER_URL,STATUS_URL[,CONCURRENCY] (repeatable). CONCURRENCY only used when the server reports unlimited rate. If unset, defaults to overpass-api.de and overpass.private.coffee.`)
-	flag.Parse()
+	pf.cacheDir = fs.String(`cache-dir`, defaultCacheDir, `directory to cache results in`)
+	pf.cacheTTL = fs.Duration(`cache-ttl`, 28*24*time.Hour, `maximum age of cached API responses before re-querying`)
+	pf.shareSlots = fs.Bool(`share-slots`, false, `share each Overpass server's slots with every other process on this host using the same --cache-dir, through state files in it, so concurrent runs don't exceed the server's per-IP limit between them (unix only)`)
+	fs.DurationVar(&pf.settings.timeout, `server-timeout`, defaultServerTimeout, `Overpass server-side query timeout ([timeout:] setting); 0 uses the server's default`)
+	pf.httpTimeoutFlag = fs.Duration(`http-timeout`, 0, `how long to wait for an Overpass response (0 = --server-timeout plus 30s)`)
+	fs.Int64Var(&pf.settings.maxsize, `maxsize`, 0, `Overpass server-side memory limit in bytes ([maxsize:] setting); 0 uses the server's default`)
+	fs.BoolVar(&pf.settings.center, `center`, false, `fetch only the centre of ways and relations (out center) rather than their full geometry; responses are far smaller, but route crossings of long features like rivers are lost`)
+	fs.BoolVar(&pf.settings.compact, `compact`, false, `fetch only the centre of compact categories like shops and amenities (out center), keeping full geometry for linear and area categories like waterways and boundaries so their route crossings are kept`)
+	fs.Func(`date`, `query OSM data as it was at this RFC 3339 time ([date:] attic query), e.g. 2020-01-01T00:00:00Z`, func(v string) error {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return err
+		}
+		pf.settings.date = t
+		return nil
+	})
+	pf.incremental = fs.Bool(`incremental`, false, `refresh expired cached responses with an Overpass augmented diff since the cached result, reporting POIs added, modified or deleted since the last run, instead of re-downloading them`)
+	pf.resplit = fs.Bool(`resplit`, false, `when a server runs out of time or memory on a split's query, requeue each half of the split's route instead of retrying the whole`)
+	pf.minSplitPoints = fs.Int(`min-split-points`, 10, `fewest route points a split resplit by --resplit may have`)
+	pf.metricsAddr = fs.String(`metrics-addr`, ``, `address to expose Prometheus metrics on at /metrics, e.g. localhost:9090 (disabled if empty)`)
+	pf.endpointsConfig = fs.String(`endpoints-config`, ``, `YAML file configuring the Overpass servers to use, with per-server timeouts, headers, fixed slots, priorities and User-Agent; cannot be combined with --overpass-endpoint`)
+	fs.Var(&pf.endpoints, `overpass-endpoint`, `Overpass server as NAME=INTERPRETER_URL,STATUS_URL[,CONCURRENCY] (repeatable). CONCURRENCY only used when the server reports unlimited rate. If unset, defaults to overpass-api.de and overpass.private.coffee.`)
+	return &pf
+}
 
-	if !endpoints.set {
-		endpoints.specs = defaultEndpoints()
+// validate checks the parsed flag values and fills in defaults. It must be
+// called after the flag set has been parsed.
+func (pf *pipelineFlags) validate() error {
+	switch {
+	case *pf.endpointsConfig != "" && pf.endpoints.set:
+		return errors.New("--endpoints-config cannot be combined with --overpass-endpoint")
+	case *pf.endpointsConfig != "":
+		specs, err := loadEndpointsConfig(*pf.endpointsConfig)
+		if err != nil {
+			return err
+		}
+		pf.endpoints.specs = specs
+	case !pf.endpoints.set:
+		pf.endpoints.specs = defaultEndpoints()
 	}
+	if *pf.workers < 0 {
+		return errors.New("--workers must be at least 0")
+	}
+	if *pf.retries < 0 {
+		return errors.New("--retries must be at least 0")
+	}
+	if *pf.minSplitPoints < 2 {
+		return errors.New("--min-split-points must be at least 2")
+	}
+	if pf.settings.timeout < 0 || *pf.httpTimeoutFlag < 0 {
+		return errors.New("--server-timeout and --http-timeout must not be negative")
+	}
+	if *pf.retryMaxElapsed < 0 {
+		return errors.New("--retry-max-elapsed must not be negative")
+	}
+	if pf.settings.maxsize < 0 {
+		return errors.New("--maxsize must not be negative")
+	}
+	if pf.settings.center && pf.settings.compact {
+		return errors.New("--center cannot be combined with --compact: --center already fetches only the centre of every category")
+	}
+	if !pf.settings.date.IsZero() && *pf.incremental {
+		return errors.New("--incremental cannot be used with --date: augmented diffs only apply to current data")
+	}
+	if *pf.shareSlots && *pf.cacheDir == "" {
+		return errors.New("--share-slots needs a --cache-dir to share slots through")
+	}
+	if *pf.shareSlots && !slotSharingSupported {
+		return errors.New("--share-slots is not supported on this platform")
+	}
+	return nil
+}
 
-	if *workers < 0 {
-		log.Println("--workers must be at least 0")
-		os.Exit(1)
+// httpTimeout is how long Overpass clients wait for a response.
+func (pf *pipelineFlags) httpTimeout() time.Duration {
+	if *pf.httpTimeoutFlag > 0 {
+		return *pf.httpTimeoutFlag
 	}
-	if *retries < 0 {
-		log.Println("--retries must be at least 0")
-		os.Exit(1)
+	if pf.settings.timeout == 0 {
+		return defaultServerTimeout + httpTimeoutMargin
 	}
+	return pf.settings.timeout + httpTimeoutMargin
+}
 
-	args := flag.Args()
-	if len(args) != 1 {
-		log.Println("must provide gpx file arg")
-		os.Exit(1)
+// retryPolicy is the policy for retrying failed API requests. Failing over
+// needs another endpoint to fail over to.
+func (pf *pipelineFlags) retryPolicy() retryPolicy {
+	p := newRetryPolicy(*pf.retries)
+	p.maxElapsed = *pf.retryMaxElapsed
+	p.failover = *pf.failover && len(pf.endpoints.specs) > 1
+	return p
+}
+
+// resplitMinPoints is the fewest route points a resplit split may have, or 0
+// when resplitting is disabled.
+func (pf *pipelineFlags) resplitMinPoints() int {
+	if !*pf.resplit {
+		return 0
 	}
-	if err := mainErr(args[0], *namePrefix, *split, *workers, *retries, *failFast, *cacheDir, *cacheTTL, *out, endpoints.specs); err != nil {
-		log.Println("Error:", err.Error())
-		os.Exit(1)
+	return *pf.minSplitPoints
+}
+
+func (pf *pipelineFlags) cache() cacheConfig {
+	return cacheConfig{dir: *pf.cacheDir, ttl: *pf.cacheTTL, incremental: *pf.incremental, shareSlots: *pf.shareSlots}
+}
+
+// runConfig configures a run of the pipeline over a route.
+type runConfig struct {
+	endpoints   []endpointSpec
+	httpTimeout time.Duration
+	cache       cacheConfig
+	settings    querySettings
+	retry       retryPolicy
+	// workers caps the queries running at once, as newWorkerCap.
+	workers int
+	// resplitMinPoints configures the resplitter; 0 disables resplitting.
+	resplitMinPoints int
+
+	// The rest are the default command's own flags, which serve takes per
+	// job instead.
+	namePrefix string
+	split      uint
+	failFast   bool
+	// planBudget, when > 0, has the route planned into work units by
+	// planWorkUnits rather than split evenly.
+	planBudget float64
+}
+
+// runConfig returns the run configuration the flags set. It must be called
+// after validate.
+func (pf *pipelineFlags) runConfig() runConfig {
+	return runConfig{
+		endpoints:        pf.endpoints.specs,
+		httpTimeout:      pf.httpTimeout(),
+		cache:            pf.cache(),
+		settings:         pf.settings,
+		retry:            pf.retryPolicy(),
+		workers:          *pf.workers,
+		resplitMinPoints: pf.resplitMinPoints(),
 	}
-	os.Exit(0)
 }
 
 // segmentIntersection tests whether segments p1-p2 and p3-p4 intersect, and
@@ -664,132 +1240,367 @@ func wayRouteIntersections(wayGeometry []LatLon, routePoints []gpxgo.GPXPoint) (
 	return crossings, closest
 }
 
-func mainErr(file string, namePrefix string, split uint, workers int, retries int, failFast bool, cacheDir string, cacheTTL time.Duration, out string, endpoints []endpointSpec) error {
-	if split == 0 {
+func mainErr(file, out string, config runConfig, traffic trafficTap, events eventSink) error {
+	if config.split == 0 {
 		return fmt.Errorf("--split must be greater than 0")
 	}
-	if len(endpoints) == 0 {
+	if len(config.endpoints) == 0 {
 		return fmt.Errorf("no overpass endpoints configured")
 	}
 
 	ctx := context.Background()
-	const queryTimeout = 180 * time.Second
 
 	f, err := os.Open(file)
 	if err != nil {
 		return fmt.Errorf("opening gpx file: %w", err)
 	}
-	gpx, err := gpxgo.Parse(f)
+	pts, err := parseRoute(f)
 	if err != nil {
 		_ = f.Close()
-		return fmt.Errorf("parsing gpx file: %w", err)
+		return err
 	}
 	if err := f.Close(); err != nil {
 		return fmt.Errorf("closing gpx file: %w", err)
 	}
 
+	if err := ensureCacheDir(config.cache.dir); err != nil {
+		return err
+	}
+
+	slog.Info("route loaded", "points", len(pts))
+
+	// The stats only guide planning, so a run goes ahead without them, and
+	// saves fresh ones over any it couldn't read.
+	groupStats, err := loadCategoryStats(config.cache.dir)
+	if err != nil {
+		slog.Warn("loading category stats for planning, starting afresh", "err", err)
+		groupStats = categoryStats{}
+	}
+	var workUnits []workUnit
+	if config.planBudget > 0 {
+		workUnits = planWorkUnits(pts, config.split, queries, groupStats, config.planBudget)
+	} else {
+		workUnits = splitWorkUnits(pts, config.split, queries)
+	}
+	// Affinity is only a routing hint, so a run goes ahead without it, and
+	// saves fresh affinity over any it couldn't read.
+	affinity, err := loadEndpointAffinity(config.cache.dir)
+	if err != nil {
+		slog.Warn("loading endpoint affinity, starting afresh", "err", err)
+		affinity = endpointAffinity{}
+	}
+	affinity.assign(workUnits, config.settings)
+
+	slog.Info("processing splits", "splits", len(workUnits))
+	for _, unit := range workUnits {
+		events.emit(runEvent{Type: eventSplitQueued, Split: unit.splitIndex + 1})
+	}
+
+	// poolCtx governs the worker pool and the client provisioning status
+	// fetches. Cancelling it — once all work is drained, or on failFast — aborts
+	// any still-in-flight status fetch on a slow server so the command returns
+	// immediately instead of waiting out that server's status timeout.
+	poolCtx, cancelPool := context.WithCancel(ctx)
+	defer cancelPool()
+
+	clientsReady, waitProvisioned := provisionClients(poolCtx, config.endpoints, config.httpTimeout, config.cache.sharedSlotsDir(), traffic, events)
+	var readyClients []namedClient
+	// readyClients is only known once every provisioning goroutine has
+	// finished, which is after processUnits below. Deferred close runs at
+	// return, after the waitProvisioned() call has populated it.
+	defer func() {
+		for _, nc := range readyClients {
+			nc.client.Close()
+		}
+	}()
+
+	var resplit *resplitter
+	if config.resplitMinPoints > 0 {
+		resplit = newResplitter(config.resplitMinPoints, len(workUnits))
+	}
+	// unitProcessor runs on poolCtx (not the background ctx) so that queries,
+	// retry backoff, and slot-waits are cancelled on failFast/shutdown rather
+	// than running to completion after the pool has given up.
+	processUnits := concurrentUnitsWorker(poolCtx, cancelPool, clientsReady, unitProcessor(poolCtx, config.cache, retrier[queryOutcome](config.retry), config.settings, resplit, events), routeUnit, config.failFast, newWorkerCap(config.workers))
+	results, err := processUnits(workUnits...)
+	// Wait for every provisioning goroutine to finish (provisioned, failed, or
+	// cancelled) before using the clients — processUnits may return before
+	// they wind down (e.g. no work units, or work finished on another server).
+	readyClients = waitProvisioned()
+	if len(readyClients) == 0 {
+		return fmt.Errorf("no overpass servers available")
+	}
+	if err != nil {
+		return err
+	}
+
+	groupStats.record(results)
+	if err := groupStats.save(config.cache.dir); err != nil {
+		slog.Warn("saving category stats for planning", "err", err)
+	}
+	affinity.record(results)
+	if err := affinity.save(config.cache.dir); err != nil {
+		slog.Warn("saving endpoint affinity", "err", err)
+	}
+
+	pois, getStats, err := collectPois(results, config.namePrefix)
+	if err != nil {
+		return err
+	}
+	events.emit(poiCountsEvent(pois))
+
+	w, wClose, err := openOutput(out)
+	if err != nil {
+		return err
+	}
+
+	if err := writePois(pois, getStats, w); err != nil {
+		if wClose != nil {
+			_ = wClose()
+		}
+		return fmt.Errorf("writing pois: %w", err)
+	}
+	if wClose != nil {
+		if err := wClose(); err != nil {
+			return fmt.Errorf("closing output json writer: %w", err)
+		}
+	}
+
+	logElementChanges(results)
+
+	stats := getStats(20)
+	for _, occurrence := range stats.tagOccurrences {
+		slog.Info("tag", "tag", occurrence.value, "count", occurrence.freq)
+	}
+	for _, occurrence := range stats.tagValueOccurrences {
+		slog.Info("tag value", "tag_value", occurrence.value, "count", occurrence.freq)
+	}
+
+	return nil
+}
+
+// defaultServerTimeout is the Overpass [timeout:] setting used unless
+// --server-timeout is given.
+const defaultServerTimeout = 180 * time.Second
+
+// httpTimeoutMargin is how much longer than the server-side timeout the HTTP
+// client waits by default, allowing for transferring the response once the
+// query has finished.
+const httpTimeoutMargin = 30 * time.Second
+
+// querySettings are the Overpass settings and output mode every query is
+// rendered with. The zero value uses the server's defaults with full geometry.
+type querySettings struct {
+	// timeout is the server-side [timeout:] setting; 0 leaves it unset.
+	timeout time.Duration
+	// maxsize is the server-side [maxsize:] memory limit in bytes; 0 leaves it
+	// unset.
+	maxsize int64
+	// center requests only the centre of ways and relations (`out center`)
+	// rather than their full geometry, which is far smaller but loses the
+	// route crossings of long features.
+	center bool
+	// compact requests `out center` for queries marked compact and full
+	// geometry only for the rest, so linear and area features like rivers,
+	// fords and boundaries keep their route crossings.
+	compact bool
+	// date is an attic [date:] to query the data as it was at; zero queries
+	// current data.
+	date time.Time
+}
+
+// statement renders the settings as the leading Overpass QL settings
+// statement.
+func (s querySettings) statement() string {
+	var sb strings.Builder
+	sb.WriteString("[out:json]")
+	if s.timeout > 0 {
+		sb.WriteString(fmt.Sprintf("[timeout:%d]", int(s.timeout.Seconds())))
+	}
+	if s.maxsize > 0 {
+		sb.WriteString(fmt.Sprintf("[maxsize:%d]", s.maxsize))
+	}
+	if !s.date.IsZero() {
+		sb.WriteString(fmt.Sprintf("[date:%q]", s.date.UTC().Format(time.RFC3339)))
+	}
+	sb.WriteString(";")
+	return sb.String()
+}
+
+// parseRoute reads a GPX document containing exactly one single-segment track
+// and returns that segment's points.
+func parseRoute(r io.Reader) ([]gpxgo.GPXPoint, error) {
+	// gpxgo.Parse fails on an io.EOF returned with the first bytes it reads,
+	// as a request body holding a short document may, so read it all first.
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading gpx file: %w", err)
+	}
+	gpx, err := gpxgo.ParseBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing gpx file: %w", err)
+	}
 	if len(gpx.Tracks) != 1 {
-		return fmt.Errorf("expected gpx file to contain exactly one track but found %d", len(gpx.Tracks))
+		return nil, fmt.Errorf("expected gpx file to contain exactly one track but found %d", len(gpx.Tracks))
 	}
 	if len(gpx.Tracks[0].Segments) != 1 {
-		return fmt.Errorf("expected gpx track to contain exactly one segment but found %d", len(gpx.Tracks[0].Segments))
+		return nil, fmt.Errorf("expected gpx track to contain exactly one segment but found %d", len(gpx.Tracks[0].Segments))
 	}
+	pts := gpx.Tracks[0].Segments[0].Points
+	if len(pts) == 0 {
+		return nil, fmt.Errorf("gpx track segment contains no points")
+	}
+	return pts, nil
+}
 
+func ensureCacheDir(cacheDir string) error {
 	stat, err := os.Stat(cacheDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(cacheDir, 0755); err != nil {
 				return fmt.Errorf("creating cache dir at %s: %w", cacheDir, err)
 			}
-			log.Printf("created cache dir at %s", cacheDir)
-		} else {
-			return fmt.Errorf("checking cache dir at %s: %w", cacheDir, err)
+			slog.Info("created cache dir", "dir", cacheDir)
+			return nil
 		}
-	} else if !stat.IsDir() {
-		return fmt.Errorf("cache dir at %s is not a directory", cacheDir)
+		return fmt.Errorf("checking cache dir at %s: %w", cacheDir, err)
 	}
-
-	pts := gpx.Tracks[0].Segments[0].Points
-	if len(pts) == 0 {
-		return fmt.Errorf("gpx track segment contains no points")
+	if !stat.IsDir() {
+		return fmt.Errorf("cache dir at %s is not a directory", cacheDir)
 	}
+	return nil
+}
 
+// splitWorkUnits splits the route into split roughly equal runs of points,
+// one work unit each.
+func splitWorkUnits(pts []gpxgo.GPXPoint, split uint, qs []query) []workUnit {
 	// TODO(glynternet): can use glynternet gpx package here instead
 	chunkSize := len(pts) / int(split)
 	if chunkSize < 1 {
 		chunkSize = 1
 	}
-	var splits [][]gpxgo.GPXPoint
+	var workUnits []workUnit
 	for i := 0; i < len(pts); i += chunkSize {
 		end := i + chunkSize
 		if end > len(pts) {
 			end = len(pts)
 		}
-		splits = append(splits, pts[i:end])
-	}
-
-	log.Println("points:", len(pts))
-
-	var workUnits []workUnit
-	for splitI, splitPoints := range splits {
 		workUnits = append(workUnits, workUnit{
-			splitIndex:  splitI,
-			queries:     queries,
-			routePoints: splitPoints,
+			splitIndex:  len(workUnits),
+			queries:     qs,
+			routePoints: pts[i:end],
 		})
 	}
+	return workUnits
+}
 
-	log.Printf("Processing %d splits", len(workUnits))
-
-	// poolCtx governs the worker pool and the client provisioning status
-	// fetches. Cancelling it — once all work is drained, or on failFast — aborts
-	// any still-in-flight status fetch on a slow server so the command returns
-	// immediately instead of waiting out that server's status timeout.
-	poolCtx, cancelPool := context.WithCancel(ctx)
-	defer cancelPool()
-
-	// Provision every endpoint concurrently and stream each client to the
-	// worker pool the moment it is ready, so a fast server starts pulling from
-	// the queue without waiting on a slow (or failing) sibling to provision.
-	// Each client contributes its full capacity; the pool's global semaphore
-	// (from --workers) caps total concurrency, so there is no per-client
-	// apportioning to do here.
-	clientsReady := make(chan clientWorkers, len(endpoints))
+// provisionClients starts a client for every endpoint concurrently and streams
+// each to the returned channel the moment it is ready, so a fast server starts
+// pulling from the queue without waiting on a slow (or failing) sibling to
+// provision. Each client contributes its full capacity; the pool's global
+// semaphore (from --workers) caps total concurrency, so there is no per-client
+// apportioning to do here.
+//
+// The channel is closed once every endpoint has been provisioned or given up
+// on. Cancelling ctx aborts in-flight status fetches. wait blocks until
+// provisioning has finished and returns every client that started, including
+// any that were ready too late to join the pool; the caller must Close them.
+// A non-empty sharedSlots is the directory through which each client shares
+// its server's slots with other processes on the host.
+func provisionClients(ctx context.Context, endpoints []endpointSpec, httpTimeout time.Duration, sharedSlots string, traffic trafficTap, events eventSink) (clientsReady <-chan clientWorkers, wait func() []namedClient) {
+	ready := make(chan clientWorkers, len(endpoints))
 	var readyMu sync.Mutex
 	var readyClients []namedClient
 	var provisionWg sync.WaitGroup
+	breakers := newBreakerGroup()
 	for _, ep := range endpoints {
 		provisionWg.Add(1)
 		go func(ep endpointSpec) {
 			defer provisionWg.Done()
-			c := overpass.NewClient(ep.Interpreter, ep.Status, queryTimeout)
-			if err := c.Start(poolCtx); err != nil {
+			timeout := httpTimeout
+			if ep.Timeout > 0 {
+				timeout = ep.Timeout
+			}
+			opts := ep.clientOptions()
+			if traffic != nil {
+				opts = append(opts, overpass.WithStatusBody(traffic.status(ep.Name)))
+			}
+			if sharedSlots != "" {
+				slots, err := newFileSlots(sharedSlots, ep.Interpreter)
+				if err != nil {
+					slog.Warn("sharing overpass server slots failed, skipping", "endpoint", ep.Name, "err", err)
+					events.emit(runEvent{Type: eventEndpoint, Endpoint: ep.Name, Outcome: endpointFailed, Error: err.Error()})
+					return
+				}
+				opts = append(opts, overpass.WithSharedSlots(slots))
+			}
+			c := overpass.NewClient(ep.Interpreter, ep.Status, timeout, append(opts,
+				overpass.WithLogger(slog.Default().With("endpoint", ep.Name)),
+				overpass.WithHooks(overpass.Hooks{
+					SlotWait: func(pending int, wait time.Duration) {
+						events.emit(runEvent{Type: eventSlotWait, Endpoint: ep.Name, Pending: pending, WaitSeconds: wait.Seconds()})
+					},
+					SlotGranted: func(waited time.Duration) {
+						metricSlotWait.observeDuration(waited, ep.Name)
+					},
+					QueueLength: func(pending int) {
+						metricQueueLength.set(float64(pending), ep.Name)
+					},
+					StatusFetched: func(err error) {
+						result := "ok"
+						if err != nil {
+							result = "error"
+						}
+						metricStatusFetches.inc(ep.Name, result)
+					},
+					Response: func(statusCode int, err error) {
+						code := "error"
+						if err == nil {
+							code = strconv.Itoa(statusCode)
+						}
+						metricResponses.inc(ep.Name, code)
+					},
+				}),
+			)...)
+			if err := c.Start(ctx); err != nil {
 				if errors.Is(err, context.Canceled) {
-					// poolCtx was cancelled because the work finished (or
+					// ctx was cancelled because the work finished (or
 					// failFast fired) before this server provisioned — not a
 					// real failure, so close it quietly without warning.
 					c.Close()
-					log.Printf("Overpass server %q provisioning cancelled (no longer needed)", ep.Name)
+					slog.Info("overpass server provisioning cancelled (no longer needed)", "endpoint", ep.Name)
+					events.emit(runEvent{Type: eventEndpoint, Endpoint: ep.Name, Outcome: endpointCancelled})
 					return
 				}
 				c.Close()
-				log.Printf("WARN: starting overpass client %q: %v (skipping)", ep.Name, err)
+				slog.Warn("starting overpass client failed, skipping", "endpoint", ep.Name, "err", err)
+				events.emit(runEvent{Type: eventEndpoint, Endpoint: ep.Name, Outcome: endpointFailed, Error: err.Error()})
 				return
 			}
 
 			var natural int
-			if c.Unlimited() {
+			if c.FixedSlots() > 0 {
+				natural = c.FixedSlots()
+				slog.Info("overpass server ready: fixed slots", "endpoint", ep.Name, "slots", natural)
+			} else if c.Unlimited() {
 				natural = ep.Concurrency
 				if natural <= 0 {
 					natural = defaultUnlimitedConcurrency
 				}
-				log.Printf("Overpass server %q ready: unlimited (using concurrency=%d)", ep.Name, natural)
+				slog.Info("overpass server ready: unlimited", "endpoint", ep.Name, "concurrency", natural)
 			} else {
 				natural = c.RateLimit()
-				log.Printf("Overpass server %q ready: rate limit=%d", ep.Name, natural)
+				slog.Info("overpass server ready", "endpoint", ep.Name, "rate_limit", natural, "announced", c.Status().AnnouncedEndpoint)
 			}
 
-			nc := namedClient{name: ep.Name, client: c}
+			nc := namedClient{
+				name:     ep.Name,
+				client:   c,
+				breaker:  breakers.add(ep.Name, c.Probe),
+				score:    &endpointScore{},
+				priority: ep.Priority,
+				traffic:  traffic,
+			}
 			readyMu.Lock()
 			readyClients = append(readyClients, nc)
 			readyMu.Unlock()
@@ -797,48 +1608,37 @@ func mainErr(file string, namePrefix string, split uint, workers int, retries in
 			// Hand the client to the pool, unless the pool is already shutting
 			// down (all work done, failFast, or no work) — in which case no
 			// worker will consume it. It's recorded in readyClients for cleanup.
+			outcome := runEvent{
+				Type:      eventEndpoint,
+				Endpoint:  ep.Name,
+				RateLimit: c.RateLimit(),
+				Unlimited: c.Unlimited(),
+				Capacity:  natural,
+			}
 			select {
-			case clientsReady <- clientWorkers{client: nc, capacity: natural}:
-				log.Printf("Overpass server %q joining pool with capacity %d", ep.Name, natural)
-			case <-poolCtx.Done():
-				log.Printf("Overpass server %q ready but no longer needed", ep.Name)
+			case ready <- clientWorkers{client: nc, capacity: natural}:
+				slog.Info("overpass server joining pool", "endpoint", ep.Name, "capacity", natural)
+				outcome.Outcome = endpointReady
+			case <-ctx.Done():
+				slog.Info("overpass server ready but no longer needed", "endpoint", ep.Name)
+				outcome.Outcome = endpointUnneeded
 			}
+			events.emit(outcome)
 		}(ep)
 	}
 	go func() {
 		provisionWg.Wait()
-		close(clientsReady)
-	}()
-	// readyClients is written by the provisioning goroutines above and read
-	// (and closed) here, so we must wait for them all to finish before touching
-	// it. Deferred close runs at return, after the provisionWg.Wait() below.
-	defer func() {
-		for _, nc := range readyClients {
-			nc.client.Close()
-		}
+		close(ready)
 	}()
-
-	retryConf := retryConfig{
-		maxRetries: retries,
-		baseDelay:  5 * time.Second,
-		maxDelay:   60 * time.Second,
-	}
-	// unitProcessor runs on poolCtx (not the background ctx) so that queries,
-	// retry backoff, and slot-waits are cancelled on failFast/shutdown rather
-	// than running to completion after the pool has given up.
-	processUnits := concurrentUnitsWorker(poolCtx, cancelPool, clientsReady, unitProcessor(poolCtx, cacheDir, cacheTTL, retrier[[]element](retryConf), queryTimeout), failFast, workers)
-	results, err := processUnits(workUnits...)
-	// Wait for every provisioning goroutine to finish (provisioned, failed, or
-	// cancelled) before reading readyClients — processUnits may return before
-	// they wind down (e.g. no work units, or work finished on another server).
-	provisionWg.Wait()
-	if len(readyClients) == 0 {
-		return fmt.Errorf("no overpass servers available")
-	}
-	if err != nil {
-		return err
+	return ready, func() []namedClient {
+		provisionWg.Wait()
+		return readyClients
 	}
+}
 
+// collectPois resolves every node and way point in results into a deduplicated
+// set of POIs, keyed by their encoded form.
+func collectPois(results []workResult, namePrefix string) (map[string]Point, func(topK int) stats, error) {
 	slices.SortFunc(results, func(a, b workResult) int {
 		return cmp.Compare(a.splitIndex, b.splitIndex)
 	})
@@ -864,58 +1664,38 @@ func mainErr(file string, namePrefix string, split uint, workers int, retries in
 	for _, result := range results {
 		for _, node := range result.nodes {
 			if err := addPoint("node", node.ID, node.Tags, LatLon{Lat: node.Lat, Lon: node.Lon}); err != nil {
-				return fmt.Errorf("adding point for node(%v): %w", node, err)
+				return nil, nil, fmt.Errorf("adding point for node(%v): %w", node, err)
 			}
 		}
 		for _, wp := range result.wayPoints {
 			if err := addPoint(wp.Type, wp.ID, wp.Tags, wp.Loc); err != nil {
-				return fmt.Errorf("adding point for wayPoint(%v): %w", wp, err)
+				return nil, nil, fmt.Errorf("adding point for wayPoint(%v): %w", wp, err)
 			}
 		}
 	}
+	return pois, getStats, nil
+}
 
-	var w io.Writer
-	var wClose func() error
+// openOutput opens the destination named by an --out flag: "-" is stdout, ""
+// is a new temp file, and anything else is a file path. wClose is nil for
+// stdout, which must not be closed.
+func openOutput(out string) (w io.Writer, wClose func() error, err error) {
 	switch out {
 	case "":
 		f, err := os.CreateTemp("", "pois-json")
 		if err != nil {
-			return fmt.Errorf("creating temp file for output: %w", err)
+			return nil, nil, fmt.Errorf("creating temp file for output: %w", err)
 		}
-		w = f
-		wClose = f.Close
+		return f, f.Close, nil
 	case "-":
-		w = os.Stdout
+		return os.Stdout, nil, nil
 	default:
 		f, err := os.OpenFile(out, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
 		if err != nil {
-			return fmt.Errorf("opening file (%s) for writing: %w", out, err)
-		}
-		w = f
-		wClose = f.Close
-	}
-
-	if err := writePois(pois, getStats, w); err != nil {
-		if wClose != nil {
-			_ = wClose()
-		}
-		return fmt.Errorf("writing pois: %w", err)
-	}
-	if wClose != nil {
-		if err := wClose(); err != nil {
-			return fmt.Errorf("closing output json writer: %w", err)
+			return nil, nil, fmt.Errorf("opening file (%s) for writing: %w", out, err)
 		}
+		return f, f.Close, nil
 	}
-
-	stats := getStats(20)
-	for _, occurrence := range stats.tagOccurrences {
-		log.Println("Tag:", occurrence.value, "=>", occurrence.freq)
-	}
-	for _, occurrence := range stats.tagValueOccurrences {
-		log.Println("Tag-Value:", occurrence.value, "=>", occurrence.freq)
-	}
-
-	return nil
 }
 
 func writePois(pois map[string]Point, getStats func(topK int) stats, out io.Writer) error {
@@ -957,17 +1737,17 @@ func writePois(pois map[string]Point, getStats func(topK int) stats, out io.Writ
 	if stats := false; stats {
 		const topK = 50
 		stats := getStats(topK)
-		log.Println("top", topK, "tags")
+		slog.Info("top tags", "k", topK)
 		for _, tagOccurrence := range stats.tagOccurrences {
-			log.Println("-", tagOccurrence.freq, tagOccurrence.value)
+			slog.Info("- "+tagOccurrence.value, "count", tagOccurrence.freq)
 		}
-		log.Println("top", topK, "tag values")
+		slog.Info("top tag values", "k", topK)
 		for _, tagValueOccurrence := range stats.tagValueOccurrences {
-			log.Println("-", tagValueOccurrence.freq, tagValueOccurrence.value)
+			slog.Info("- "+tagValueOccurrence.value, "count", tagValueOccurrence.freq)
 		}
 	}
 
-	log.Println("pois:", len(pois))
+	slog.Info("pois written", "pois", len(pois))
 	return nil
 }
 
@@ -1025,7 +1805,7 @@ func point(namePrefix string) (func(osmType string, id int64, tags map[string]st
 			}
 			category, cats := resolveCategories(tags)
 			if category == "" {
-				log.Println("No category found for tags", tags)
+				slog.Warn("no category found for tags", "tags", tags)
 			}
 			nodePoint := Point{
 				OSMID:      id,
@@ -1069,15 +1849,58 @@ func queryRouteFilter(locus int, route []gpxgo.GPXPoint) (string, error) {
 // renderUnionQuery builds a single Overpass QL union query that combines all
 // query categories for both node and way element types. Each category gets its
 // own radius-specific route filter. Using `out geom qt;` returns way geometry
-// inline, avoiding the need for separate recurse queries.
-func renderUnionQuery(queries []query, routePoints []gpxgo.GPXPoint, timeout time.Duration) (string, error) {
+// inline, avoiding the need for separate recurse queries; with settings.center,
+// `out center qt;` returns just a centre point for each way and relation.
+// With settings.compact, compact queries and the rest are collected into
+// separate sets, output with `out center qt;` and `out geom qt;` respectively.
+func renderUnionQuery(queries []query, routePoints []gpxgo.GPXPoint, settings querySettings) (string, error) {
+	var compact, full []query
+	for _, q := range queries {
+		if settings.compact && q.compact {
+			compact = append(compact, q)
+		} else {
+			full = append(full, q)
+		}
+	}
+	switch {
+	case settings.center:
+		return renderUnionStatements(queries, routePoints, settings, "out center qt;")
+	case len(compact) == 0:
+		return renderUnionStatements(queries, routePoints, settings, "out geom qt;")
+	case len(full) == 0:
+		return renderUnionStatements(queries, routePoints, settings, "out center qt;")
+	}
+
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("[out:json][timeout:%d];\n(\n", int(timeout.Seconds())))
+	sb.WriteString(settings.statement() + "\n(\n")
+	if err := writeUnionMembers(&sb, compact, routePoints); err != nil {
+		return "", err
+	}
+	sb.WriteString(")->.compact;\n(\n")
+	if err := writeUnionMembers(&sb, full, routePoints); err != nil {
+		return "", err
+	}
+	sb.WriteString(")->.full;\n.compact out center qt;\n.full out geom qt;")
+	return sb.String(), nil
+}
+
+// renderUnionStatements renders a single union of queries followed by out.
+func renderUnionStatements(queries []query, routePoints []gpxgo.GPXPoint, settings querySettings, out string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(settings.statement() + "\n(\n")
+	if err := writeUnionMembers(&sb, queries, routePoints); err != nil {
+		return "", err
+	}
+	sb.WriteString(");\n" + out)
+	return sb.String(), nil
+}
 
+// writeUnionMembers writes the node, way and rel statements of each query.
+func writeUnionMembers(sb *strings.Builder, queries []query, routePoints []gpxgo.GPXPoint) error {
 	for _, q := range queries {
 		filters, err := renderConditionFilters(q.conditions)
 		if err != nil {
-			return "", fmt.Errorf("rendering condition filters for %+v: %w", q.conditions, err)
+			return fmt.Errorf("rendering condition filters for %+v: %w", q.conditions, err)
 		}
 
 		locus := 80
@@ -1087,16 +1910,14 @@ func renderUnionQuery(queries []query, routePoints []gpxgo.GPXPoint, timeout tim
 
 		routeFilter, err := queryRouteFilter(locus, routePoints)
 		if err != nil {
-			return "", fmt.Errorf("creating route filter: %w", err)
+			return fmt.Errorf("creating route filter: %w", err)
 		}
 
 		sb.WriteString("  node" + filters + routeFilter + ");\n")
 		sb.WriteString("  way" + filters + routeFilter + ");\n")
 		sb.WriteString("  rel" + filters + routeFilter + ");\n")
 	}
-
-	sb.WriteString(");\nout geom qt;")
-	return sb.String(), nil
+	return nil
 }
 
 // processWayElement converts a single way element into wayPoints by finding
@@ -1110,6 +1931,10 @@ func processWayElement(e element, routePoints []gpxgo.GPXPoint) []wayPoint {
 		if len(e.Geometry) == 1 {
 			return []wayPoint{{Type: e.Type, ID: e.ID, Loc: e.Geometry[0], Tags: e.Tags}}
 		}
+		// Queried with `out center`: the centre is all there is.
+		if e.Center != nil {
+			return []wayPoint{{Type: e.Type, ID: e.ID, Loc: *e.Center, Tags: e.Tags}}
+		}
 		return nil
 	}
 
@@ -1171,6 +1996,10 @@ func processRelationElement(e element, routePoints []gpxgo.GPXPoint) []wayPoint
 		return nil
 	}
 
+	if e.Center != nil {
+		return []wayPoint{{Type: e.Type, ID: e.ID, Loc: *e.Center, Tags: e.Tags}}
+	}
+
 	// Fallback: use node members as point locations
 	var result []wayPoint
 	for _, m := range e.Members {
@@ -1239,81 +2068,120 @@ func renderConditionFilters(conditions []condition) (string, error) {
 	return sb.String(), nil
 }
 
+// cacheKey is the name of renderedQuery's entry in the cache dir.
+func cacheKey(renderedQuery string) string {
+	sum := sha1.Sum([]byte(renderedQuery))
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
 // queryResponseElementsRaw takes a pre-rendered Overpass query string and handles
-// caching, API execution, and JSON parsing of the response.
+// caching, API execution, and JSON parsing of the response. Responses whose
+// remark reports a runtime error are incomplete, so are returned as a
+// *remarkError and never cached.
 func queryResponseElementsRaw(
 	ctx context.Context,
-	cacheDir string,
-	cacheTTL time.Duration,
+	cache cacheConfig,
 	makeQueryRequest func(ctx context.Context, query string) (*http.Response, error),
 	renderedQuery string,
-) ([]element, error) {
-	hasher := sha1.New()
-	if _, err := hasher.Write([]byte(renderedQuery)); err != nil {
-		return nil, fmt.Errorf("hashing query: %w", err)
-	}
-	sha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+) (queryOutcome, error) {
+	sha := cacheKey(renderedQuery)
 
-	var rc io.ReadCloser
-	queryStateFilePath := filepath.Join(cacheDir, sha)
+	cacheStatus := cacheMiss
+	queryStateFilePath := filepath.Join(cache.dir, sha)
 	if info, err := os.Stat(queryStateFilePath); err == nil {
-		if time.Since(info.ModTime()) > cacheTTL {
-			log.Printf("cache expired (age %s > ttl %s): %s",
-				time.Since(info.ModTime()).Round(time.Second), cacheTTL, renderedQuery[:min(80, len(renderedQuery))])
+		if time.Since(info.ModTime()) > cache.ttl {
+			cacheStatus = cacheExpired
+			metricCacheLookups.inc(cacheExpired)
+			slog.Info("cache expired",
+				"age", time.Since(info.ModTime()).Round(time.Second), "ttl", cache.ttl, "query", renderedQuery[:min(80, len(renderedQuery))])
+			if cache.incremental {
+				elements, changes, err := updateCachedResponse(ctx, cache.dir, makeQueryRequest, renderedQuery, queryStateFilePath)
+				if err == nil {
+					return queryOutcome{elements: elements, changes: changes, cache: cacheUpdated}, nil
+				}
+				if !errors.Is(err, errNoBaseTimestamp) {
+					return queryOutcome{}, fmt.Errorf("updating cached result incrementally: %w", err)
+				}
+				slog.Info("cached result has no base timestamp, re-downloading", "path", queryStateFilePath)
+			}
 		} else {
-			stored, err := os.Open(queryStateFilePath)
+			r, err := readResponseFile(queryStateFilePath)
 			if err != nil {
-				return nil, fmt.Errorf("opening cached query state file(%s): %w", queryStateFilePath, err)
+				return queryOutcome{}, fmt.Errorf("reading cached query state file: %w", err)
 			}
-			if debug {
-				log.Printf("query fetched from cached result: %s", queryStateFilePath)
+			// Entries cached before remarks were checked may be incomplete.
+			if remarkErr := parseRemark(r.Remark); remarkErr != nil {
+				slog.Warn("cached result is incomplete, re-querying", "path", queryStateFilePath, "remark", remarkErr.remark)
+				if err := os.Remove(queryStateFilePath); err != nil {
+					return queryOutcome{}, fmt.Errorf("removing incomplete cached result: %w", err)
+				}
+			} else {
+				slog.Debug("query fetched from cached result", "path", queryStateFilePath)
+				metricCacheLookups.inc(cacheHit)
+				return queryOutcome{elements: r.Elements, cache: cacheHit}, nil
 			}
-			rc = stored
 		}
 	} else if !errors.Is(err, os.ErrNotExist) {
-		return nil, fmt.Errorf("checking cache file(%s): %w", queryStateFilePath, err)
+		return queryOutcome{}, fmt.Errorf("checking cache file(%s): %w", queryStateFilePath, err)
+	}
+	// Expired lookups are counted above, as an incremental update returns early.
+	if cacheStatus == cacheMiss {
+		metricCacheLookups.inc(cacheMiss)
 	}
 
-	if rc == nil {
-		log.Printf("query result not cached, making query to API: %s", renderedQuery[:min(80, len(renderedQuery))])
-		resp, err := makeQueryRequest(ctx, renderedQuery)
-		if err != nil {
-			return nil, fmt.Errorf("posting query: %w", err)
-		}
-		if resp.StatusCode != http.StatusOK {
-			_ = resp.Body.Close()
-			return nil, &httpStatusError{statusCode: resp.StatusCode, status: resp.Status}
-		}
-		if err := atomicSlurp(cacheDir, resp.Body, queryStateFilePath); err != nil {
-			_ = resp.Body.Close()
-			return nil, fmt.Errorf("storing content into cache: %w", err)
-		}
-		if err := resp.Body.Close(); err != nil {
-			return nil, fmt.Errorf("closing response body: %w", err)
-		}
-
-		if debug {
-			log.Printf("query result written: %s", queryStateFilePath)
+	slog.Info("query result not cached, making query to API", "query", renderedQuery[:min(80, len(renderedQuery))])
+	resp, err := makeQueryRequest(ctx, renderedQuery)
+	if err != nil {
+		return queryOutcome{}, fmt.Errorf("posting query: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return queryOutcome{}, newHTTPStatusError(resp)
+	}
+	var r response
+	validate := func(tmpPath string) error {
+		var err error
+		if r, err = readResponseFile(tmpPath); err != nil {
+			return err
 		}
-		stored, err := os.Open(queryStateFilePath)
-		if err != nil {
-			return nil, fmt.Errorf("opening cached result after write: %w", err)
+		if remarkErr := parseRemark(r.Remark); remarkErr != nil {
+			return remarkErr
 		}
-		rc = stored
+		return nil
 	}
+	if err := atomicSlurp(cache.dir, resp.Body, queryStateFilePath, validate); err != nil {
+		_ = resp.Body.Close()
+		return queryOutcome{}, fmt.Errorf("caching response: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		return queryOutcome{}, fmt.Errorf("closing response body: %w", err)
+	}
+	slog.Debug("query result written", "path", queryStateFilePath)
+	return queryOutcome{elements: r.Elements, cache: cacheStatus}, nil
+}
 
+// readResponseFile decodes the Overpass JSON response stored at path.
+func readResponseFile(path string) (response, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return response{}, fmt.Errorf("opening %s: %w", path, err)
+	}
 	var r response
-	if err := json.NewDecoder(rc).Decode(&r); err != nil {
-		_ = rc.Close()
-		return nil, fmt.Errorf("decoding response body: %w", err)
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		_ = f.Close()
+		return response{}, fmt.Errorf("decoding %s: %w", path, err)
 	}
-	if err := rc.Close(); err != nil {
-		return nil, fmt.Errorf("closing response body: %w", err)
+	if err := f.Close(); err != nil {
+		return response{}, fmt.Errorf("closing %s: %w", path, err)
 	}
-	return r.Elements, nil
+	return r, nil
 }
 
-func atomicSlurp(cacheDir string, resp io.Reader, path string) error {
+// atomicSlurp writes resp to path via a temp file in cacheDir, so a partial
+// write is never visible at path. If validate is non-nil it is called on the
+// complete temp file before the rename; an error from it abandons the write
+// and is returned as is.
+func atomicSlurp(cacheDir string, resp io.Reader, path string, validate func(tmpPath string) error) error {
 	tmpFile, err := os.CreateTemp(cacheDir, ".tmp-*")
 	if err != nil {
 		return fmt.Errorf("creating temp file for cache write: %w", err)
@@ -1327,6 +2195,12 @@ func atomicSlurp(cacheDir string, resp io.Reader, path string) error {
 		_ = os.Remove(tmpFile.Name())
 		return fmt.Errorf("closing temp file: %w", err)
 	}
+	if validate != nil {
+		if err := validate(tmpFile.Name()); err != nil {
+			_ = os.Remove(tmpFile.Name())
+			return err
+		}
+	}
 	if err := os.Rename(tmpFile.Name(), path); err != nil {
 		_ = os.Remove(tmpFile.Name())
 		return fmt.Errorf("renaming temp file to cache path: %w", err)
@@ -1367,7 +2241,7 @@ func resolveName(tags map[string]string) (string, error) {
 	}
 	if len(yesTags) > 0 {
 		slices.Sort(yesTags)
-		log.Printf(`Resolved name from tags with value "yes": %s`, yesTags)
+		slog.Debug(`resolved name from tags with value "yes"`, "tags", yesTags)
 		return strings.Join(yesTags, " "), nil
 	}
 	return "", errors.New("no suitable tag for name")
@@ -3,10 +3,18 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
 	"slices"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+	"github.com/glynternet/route-poi-finder/overpass/overpasstest"
+	gpxgo "github.com/tkrajina/gpxgo/gpx"
 )
 
 func Test_orderRetainingUniqCompact(t *testing.T) {
@@ -31,8 +39,9 @@ func Test_concurrentUnitsWorker_noUnits(t *testing.T) {
 			t.Error("processUnit must not be called when there are no units")
 			return 0, nil
 		},
+		nil,
 		true,
-		0,
+		nil,
 	)
 
 	done := make(chan struct{})
@@ -88,8 +97,8 @@ func readyClients(specs ...clientWorkers) <-chan clientWorkers {
 	return ch
 }
 
-// With --workers set, no more than that many units may run concurrently across
-// all clients, even when the clients' combined capacity is higher.
+// With --workers set, no more than that many units may run queries concurrently
+// across all clients, even when the clients' combined capacity is higher.
 func Test_concurrentUnitsWorker_globalCapRespected(t *testing.T) {
 	const workers = 3
 	const nUnits = 60
@@ -105,13 +114,19 @@ func Test_concurrentUnitsWorker_globalCapRespected(t *testing.T) {
 	var track concurrencyTracker
 	process := concurrentUnitsWorker(
 		ctx, cancel, clients,
-		func(namedClient, int) (int, error) {
+		func(c namedClient, _ int) (int, error) {
+			release, err := c.admit(ctx)
+			if err != nil {
+				return 0, err
+			}
+			defer release()
 			track.enter()
 			time.Sleep(2 * time.Millisecond)
 			track.leave()
 			return 0, nil
 		},
-		false, workers,
+		nil,
+		false, newWorkerCap(workers),
 	)
 
 	results, err := process(make([]int, nUnits)...)
@@ -129,6 +144,92 @@ func Test_concurrentUnitsWorker_globalCapRespected(t *testing.T) {
 	}
 }
 
+// A query waiting for its server to grant a slot must not hold a --workers
+// slot, and a running query holds both until its response body is closed.
+func Test_namedClient_query(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"elements":[]}`))
+	}))
+	defer srv.Close()
+	client := overpass.NewClient(srv.URL, "", time.Second, overpass.WithFixedSlots(1))
+	defer client.Close()
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	c := namedClient{name: "a", client: client, workers: make(chan struct{}, 2)}
+
+	first, err := c.query(context.Background(), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := make(chan error)
+	go func() {
+		resp, err := c.query(context.Background(), "q")
+		if err == nil {
+			err = resp.Body.Close()
+		}
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if n := len(c.workers); n != 1 {
+		t.Fatalf("expected only the running query to hold a worker slot, got %d", n)
+	}
+	if err := first.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.workers); n != 0 {
+		t.Fatalf("expected every worker slot to be released, got %d", n)
+	}
+}
+
+// The client, retrier and cache together against a fake server: a 504 is
+// retried, the result cached and served from the cache after, and a result the
+// server reports as timed out is neither returned nor cached.
+func Test_queryResponseElementsRaw_endToEnd(t *testing.T) {
+	srv := overpasstest.NewServer(2, 0)
+	defer srv.Close()
+	srv.Respond("way", overpasstest.Fixture("remark_timeout"))
+	srv.Respond("", overpasstest.GatewayTimeout(), overpasstest.Fixture("elements"))
+
+	client := overpass.NewClient(srv.InterpreterURL(), srv.StatusURL(), 5*time.Second)
+	defer client.Close()
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	c := namedClient{name: "fake", client: client}
+	cache := cacheConfig{dir: t.TempDir(), ttl: time.Hour}
+	retry := retrier[queryOutcome](retryPolicy{maxRetries: 2})
+	query := func(q string) (queryOutcome, retryState, error) {
+		var state retryState
+		outcome, err := retry(context.Background(), &state, func() (queryOutcome, error) {
+			return queryResponseElementsRaw(context.Background(), cache, c.query, q)
+		})
+		return outcome, state, err
+	}
+
+	outcome, state, err := query("[out:json];node;out;")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.attempts != 2 || outcome.cache != cacheMiss || len(outcome.elements) != 2 {
+		t.Fatalf("expected 2 elements from the API after a retry, got %d from %s after %d attempts", len(outcome.elements), outcome.cache, state.attempts)
+	}
+	if outcome, _, err = query("[out:json];node;out;"); err != nil || outcome.cache != cacheHit {
+		t.Fatalf("expected a cache hit, got %s and %v", outcome.cache, err)
+	}
+
+	var remarkErr *remarkError
+	if _, _, err := query("[out:json];way;out;"); !errors.As(err, &remarkErr) {
+		t.Fatalf("expected a remark error, got %v", err)
+	}
+	if stats := srv.Stats(); stats.Queries != 3+2 {
+		t.Errorf("expected 2 queries for the node query and 3 for the timed out way query, got %d", stats.Queries)
+	}
+}
+
 // With --workers 0 (uncapped), concurrency should be able to exceed any single
 // client's capacity and reach the sum of the clients' capacities.
 func Test_concurrentUnitsWorker_uncappedUsesFullCapacity(t *testing.T) {
@@ -151,7 +252,8 @@ func Test_concurrentUnitsWorker_uncappedUsesFullCapacity(t *testing.T) {
 			track.leave()
 			return 0, nil
 		},
-		false, 0, // uncapped
+		nil,
+		false, nil, // uncapped
 	)
 
 	results, err := process(make([]int, nUnits)...)
@@ -180,7 +282,8 @@ func Test_concurrentUnitsWorker_failFastCancelsContext(t *testing.T) {
 	process := concurrentUnitsWorker(
 		ctx, cancel, clients,
 		func(namedClient, int) (int, error) { return 0, wantErr },
-		true, 0,
+		nil,
+		true, nil,
 	)
 
 	_, err := process(make([]int, 20)...)
@@ -191,3 +294,226 @@ func Test_concurrentUnitsWorker_failFastCancelsContext(t *testing.T) {
 		t.Fatal("failFast did not cancel the shared context")
 	}
 }
+
+// A unit requeued as several smaller units must be replaced by them: the pool
+// keeps running until each of those has a result.
+func Test_concurrentUnitsWorker_requeue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := readyClients(clientWorkers{client: namedClient{name: "a"}, capacity: 2})
+
+	// Units above 1 are halved until they reach 1, so each unit n yields n
+	// results.
+	process := concurrentUnitsWorker(
+		ctx, cancel, clients,
+		func(_ namedClient, n int) (int, error) {
+			if n > 1 {
+				return 0, &requeueError[int]{units: []int{n / 2, n - n/2}, cause: errors.New("too big")}
+			}
+			return n, nil
+		},
+		nil,
+		true, nil,
+	)
+
+	results, err := process(1, 4, 7)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 12 {
+		t.Fatalf("expected 12 results, got %d: %v", len(results), results)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("expected the shared context to be cancelled once all units were processed")
+	}
+}
+
+func Test_renderUnionQuery_settings(t *testing.T) {
+	qs := []query{{conditions: []condition{{tag: "amenity", values: []string{"cafe"}}}}}
+	route := []gpxgo.GPXPoint{{Point: gpxgo.Point{Latitude: 51, Longitude: -1}}}
+
+	actual, err := renderUnionQuery(qs, route, querySettings{
+		timeout: 60 * time.Second,
+		maxsize: 1 << 30,
+		center:  true,
+		date:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "[out:json][timeout:60][maxsize:1073741824][date:\"2020-01-02T03:04:05Z\"];\n(\n" +
+		"  node[amenity~\"^(cafe)$\"](around:80,51.000000,-1.000000);\n" +
+		"  way[amenity~\"^(cafe)$\"](around:80,51.000000,-1.000000);\n" +
+		"  rel[amenity~\"^(cafe)$\"](around:80,51.000000,-1.000000);\n" +
+		");\nout center qt;"
+	if actual != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+
+	actual, err = renderUnionQuery(qs, route, querySettings{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(actual, "[out:json];") || !strings.HasSuffix(actual, "out geom qt;") {
+		t.Fatalf("expected the zero settings to render server defaults with full geometry, got:\n%s", actual)
+	}
+}
+
+func Test_renderUnionQuery_compact(t *testing.T) {
+	cafes := query{compact: true, conditions: []condition{{tag: "amenity", values: []string{"cafe"}}}}
+	rivers := query{radius: 500, conditions: []condition{{tag: "waterway", values: []string{"river"}}}}
+	route := []gpxgo.GPXPoint{{Point: gpxgo.Point{Latitude: 51, Longitude: -1}}}
+
+	actual, err := renderUnionQuery([]query{cafes, rivers}, route, querySettings{compact: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "[out:json];\n(\n" +
+		"  node[amenity~\"^(cafe)$\"](around:80,51.000000,-1.000000);\n" +
+		"  way[amenity~\"^(cafe)$\"](around:80,51.000000,-1.000000);\n" +
+		"  rel[amenity~\"^(cafe)$\"](around:80,51.000000,-1.000000);\n" +
+		")->.compact;\n(\n" +
+		"  node[waterway~\"^(river)$\"](around:500,51.000000,-1.000000);\n" +
+		"  way[waterway~\"^(river)$\"](around:500,51.000000,-1.000000);\n" +
+		"  rel[waterway~\"^(river)$\"](around:500,51.000000,-1.000000);\n" +
+		")->.full;\n.compact out center qt;\n.full out geom qt;"
+	if actual != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+
+	for _, tc := range []struct {
+		queries []query
+		out     string
+	}{
+		{queries: []query{cafes}, out: "\nout center qt;"},
+		{queries: []query{rivers}, out: "\nout geom qt;"},
+	} {
+		actual, err := renderUnionQuery(tc.queries, route, querySettings{compact: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if strings.Contains(actual, "->.") || !strings.HasSuffix(actual, tc.out) {
+			t.Errorf("expected a single union ending %q, got:\n%s", tc.out, actual)
+		}
+	}
+}
+
+func Test_processWayElement_center(t *testing.T) {
+	route := []gpxgo.GPXPoint{{Point: gpxgo.Point{Latitude: 51, Longitude: -1}}}
+	e := element{Type: "way", ID: 7, Center: &LatLon{Lat: 51.001, Lon: -1.001}, Tags: map[string]string{"amenity": "restaurant"}}
+	wps := processWayElement(e, route)
+	if len(wps) != 1 || wps[0].Loc != *e.Center {
+		t.Fatalf("expected a single way point at the centre, got %+v", wps)
+	}
+}
+
+// A unit that fails over from one endpoint must be routed to another.
+func Test_concurrentUnitsWorker_failover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients := readyClients(
+		clientWorkers{client: namedClient{name: "a"}, capacity: 1},
+		clientWorkers{client: namedClient{name: "b"}, capacity: 1},
+	)
+
+	var failovers atomic.Int64
+	process := concurrentUnitsWorker(
+		ctx, cancel, clients,
+		func(c namedClient, unit workUnit) (string, error) {
+			if c.name == "a" {
+				failovers.Add(1)
+				unit.avoid = append(unit.avoid, c.name)
+				return "", &requeueError[workUnit]{units: []workUnit{unit}, cause: errors.New("bad gateway")}
+			}
+			return c.name, nil
+		},
+		routeUnit,
+		true, nil,
+	)
+
+	results, err := process(make([]workUnit, 10)...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 10 {
+		t.Fatalf("expected 10 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r != "b" {
+			t.Fatalf("expected every unit to complete on b, got %v", results)
+		}
+	}
+	if n := failovers.Load(); n > 10 {
+		t.Errorf("expected each unit to fail on a at most once, got %d failures", n)
+	}
+}
+
+// A 429 is only retried at once when the client holds the retry back itself.
+// A client sending to an unlimited server doesn't, so the retry backs off.
+func Test_processWorkUnit_tooManyRequests(t *testing.T) {
+	unit := workUnit{
+		queries:     []query{{conditions: []condition{{tag: "amenity", values: []string{"cafe"}}}}},
+		routePoints: []gpxgo.GPXPoint{{Point: gpxgo.Point{Latitude: 51, Longitude: -1}}},
+	}
+	policy := newRetryPolicy(1)
+	for _, tc := range []struct {
+		name      string
+		rateLimit int
+		throttled bool
+	}{
+		{name: "rate limited", rateLimit: 2, throttled: true},
+		{name: "unlimited", rateLimit: 0, throttled: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := overpasstest.NewServer(tc.rateLimit, 0)
+			defer srv.Close()
+			srv.Respond("", overpasstest.TooManyRequests(0))
+			client := overpass.NewClient(srv.InterpreterURL(), srv.StatusURL(), 5*time.Second)
+			defer client.Close()
+			if err := client.Start(context.Background()); err != nil {
+				t.Fatalf("starting client: %v", err)
+			}
+
+			once := func(_ context.Context, _ *retryState, queryFn func() (queryOutcome, error)) (queryOutcome, error) {
+				return queryFn()
+			}
+			_, err := processWorkUnit(context.Background(), cacheConfig{dir: t.TempDir(), ttl: time.Hour}, once, querySettings{}, false, nil, namedClient{name: "fake", client: client}, unit)
+			var httpErr *httpStatusError
+			if !errors.As(err, &httpErr) || httpErr.statusCode != http.StatusTooManyRequests {
+				t.Fatalf("expected a 429, got %v", err)
+			}
+			if httpErr.throttled != tc.throttled {
+				t.Fatalf("expected throttled to be %t", tc.throttled)
+			}
+			if d := policy.delay(err, 1); (d == 0) != tc.throttled {
+				t.Errorf("expected a throttled 429 alone to be retried at once, got a delay of %s", d)
+			}
+		})
+	}
+}
+
+func Test_pipelineFlags_validate(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		invalid bool
+	}{
+		{args: nil},
+		{args: []string{"-center"}},
+		{args: []string{"-compact"}},
+		{args: []string{"-center", "-compact"}, invalid: true},
+		{args: []string{"-incremental", "-date", "2020-01-01T00:00:00Z"}, invalid: true},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			pf := registerPipelineFlags(fs)
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := pf.validate(); (err != nil) != tc.invalid {
+				t.Errorf("expected invalid %t, got %v", tc.invalid, err)
+			}
+		})
+	}
+}
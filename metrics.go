@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics is the process-wide registry every instrumented component records
+// to. It is exposed in the Prometheus text format by --metrics-addr and
+// summarised in the log at the end of a CLI run.
+var metrics = newMetricsRegistry()
+
+var (
+	metricSlotWait = metrics.histogram(
+		"route_poi_finder_overpass_slot_wait_seconds",
+		"Time spent waiting for an Overpass API slot before a query could run.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
+		"endpoint")
+	metricStatusFetches = metrics.counter(
+		"route_poi_finder_overpass_status_fetches_total",
+		"Overpass /api/status fetches, by result (ok or error).",
+		"endpoint", "result")
+	metricQueueLength = metrics.gauge(
+		"route_poi_finder_overpass_queue_length",
+		"Requests queued in the Overpass client's slot coordinator.",
+		"endpoint")
+	metricResponses = metrics.counter(
+		"route_poi_finder_overpass_responses_total",
+		`Overpass interpreter responses by HTTP status code, or "error" when no response was received.`,
+		"endpoint", "code")
+	metricRetryAttempts = metrics.counter(
+		"route_poi_finder_retry_attempts_total",
+		"Retries of failed API requests.")
+	metricRetryGiveUps = metrics.counter(
+		"route_poi_finder_retry_give_ups_total",
+		"API requests given up on, by reason (exhausted retries, elapsed retry time or not_retryable error).",
+		"reason")
+	metricRetryFailovers = metrics.counter(
+		"route_poi_finder_retry_failovers_total",
+		"Units handed back to the pool to retry on another endpoint after a server or network error.")
+	metricCircuitOpen = metrics.gauge(
+		"route_poi_finder_endpoint_circuit_open",
+		"Whether an endpoint's circuit breaker has taken it out of the pool (1) or not (0).",
+		"endpoint")
+	metricCacheLookups = metrics.counter(
+		"route_poi_finder_cache_lookups_total",
+		"Query result cache lookups, by status (hit, miss or expired).",
+		"status")
+)
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// metricsRegistry holds a set of labelled metric families. It is a minimal
+// stand-in for a Prometheus client library, supporting just the counters,
+// gauges and histograms this tool records.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+// metricFamily is one named metric and its series, keyed by label values.
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64 // histogram upper bounds, ascending
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter or gauge value; histogram sum
+	count       uint64   // histogram observation count
+	buckets     []uint64 // histogram per-bucket (non-cumulative) counts
+}
+
+func (r *metricsRegistry) register(f *metricFamily) *metricFamily {
+	f.series = make(map[string]*metricSeries)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct{ f *metricFamily }
+
+func (r *metricsRegistry) counter(name, help string, labelNames ...string) counterVec {
+	return counterVec{r.register(&metricFamily{name: name, help: help, kind: metricCounter, labelNames: labelNames})}
+}
+
+// inc adds one to the series with the given label values, which must match
+// the family's label names in number and order.
+func (c counterVec) inc(labelValues ...string) {
+	c.f.update(labelValues, func(s *metricSeries) { s.value++ })
+}
+
+// gaugeVec is a gauge partitioned by label values.
+type gaugeVec struct{ f *metricFamily }
+
+func (r *metricsRegistry) gauge(name, help string, labelNames ...string) gaugeVec {
+	return gaugeVec{r.register(&metricFamily{name: name, help: help, kind: metricGauge, labelNames: labelNames})}
+}
+
+func (g gaugeVec) set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *metricSeries) { s.value = v })
+}
+
+// histogramVec is a histogram partitioned by label values.
+type histogramVec struct{ f *metricFamily }
+
+func (r *metricsRegistry) histogram(name, help string, buckets []float64, labelNames ...string) histogramVec {
+	return histogramVec{r.register(&metricFamily{name: name, help: help, kind: metricHistogram, labelNames: labelNames, buckets: buckets})}
+}
+
+func (h histogramVec) observe(v float64, labelValues ...string) {
+	h.f.update(labelValues, func(s *metricSeries) {
+		s.value += v
+		s.count++
+		// Values above the largest bound only count towards +Inf.
+		if i, _ := slices.BinarySearch(h.f.buckets, v); i < len(h.f.buckets) {
+			s.buckets[i]++
+		}
+	})
+}
+
+func (h histogramVec) observeDuration(d time.Duration, labelValues ...string) {
+	h.observe(d.Seconds(), labelValues...)
+}
+
+func (f *metricFamily) update(labelValues []string, fn func(s *metricSeries)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s: got %d label values for labels %v", f.name, len(labelValues), f.labelNames))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: slices.Clone(labelValues)}
+		if f.kind == metricHistogram {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// snapshot returns copies of the family's series, sorted by label values so
+// output is stable.
+func (f *metricFamily) snapshot() []metricSeries {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	series := make([]metricSeries, 0, len(f.series))
+	for _, s := range f.series {
+		c := *s
+		c.buckets = slices.Clone(s.buckets)
+		series = append(series, c)
+	}
+	slices.SortFunc(series, func(a, b metricSeries) int {
+		return slices.Compare(a.labelValues, b.labelValues)
+	})
+	return series
+}
+
+func (r *metricsRegistry) snapshotFamilies() []*metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.families)
+}
+
+// writeText writes every metric in the Prometheus text exposition format.
+func (r *metricsRegistry) writeText(w io.Writer) error {
+	var sb strings.Builder
+	for _, f := range r.snapshotFamilies() {
+		_, _ = fmt.Fprintf(&sb, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		_, _ = fmt.Fprintf(&sb, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.snapshot() {
+			if f.kind != metricHistogram {
+				_, _ = fmt.Fprintf(&sb, "%s%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, upper := range f.buckets {
+				cumulative += s.buckets[i]
+				_, _ = fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name,
+					formatLabels(append(slices.Clone(f.labelNames), "le"), append(slices.Clone(s.labelValues), formatFloat(upper))), cumulative)
+			}
+			_, _ = fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name,
+				formatLabels(append(slices.Clone(f.labelNames), "le"), append(slices.Clone(s.labelValues), "+Inf")), s.count)
+			_, _ = fmt.Fprintf(&sb, "%s_sum%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues), formatFloat(s.value))
+			_, _ = fmt.Fprintf(&sb, "%s_count%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues), s.count)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (r *metricsRegistry) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.writeText(w); err != nil {
+			slog.Warn("writing metrics", "err", err)
+		}
+	})
+}
+
+// logSummary logs one line per recorded series: the value of counters and
+// gauges, and the count and mean of histograms.
+func (r *metricsRegistry) logSummary() {
+	for _, f := range r.snapshotFamilies() {
+		name := strings.TrimPrefix(f.name, "route_poi_finder_")
+		for _, s := range f.snapshot() {
+			attrs := make([]any, 0, 2*len(f.labelNames)+4)
+			for i, l := range f.labelNames {
+				attrs = append(attrs, l, s.labelValues[i])
+			}
+			if f.kind == metricHistogram {
+				mean := 0.0
+				if s.count > 0 {
+					mean = s.value / float64(s.count)
+				}
+				attrs = append(attrs, "count", s.count, "mean", strconv.FormatFloat(mean, 'f', 3, 64))
+			} else {
+				attrs = append(attrs, "value", s.value)
+			}
+			slog.Info("metric "+name, attrs...)
+		}
+	}
+}
+
+// serveMetrics exposes the registry at /metrics on addr until the process
+// exits. Failing to listen is logged rather than fatal: metrics are an aid,
+// not a reason to abandon a run.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.handler())
+	go func() {
+		slog.Info("serving metrics", "url", "http://"+addr+"/metrics")
+		if err := http.ListenAndServe(addr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("serving metrics", "err", err)
+		}
+	}()
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string { return labelValueEscaper.Replace(v) }
+
+func escapeHelp(v string) string { return helpEscaper.Replace(v) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_metricsRegistry_writeText(t *testing.T) {
+	r := newMetricsRegistry()
+	responses := r.counter("responses_total", "Responses by code.", "endpoint", "code")
+	queue := r.gauge("queue_length", "Queued requests.", "endpoint")
+	wait := r.histogram("wait_seconds", "Slot waits.", []float64{1, 10}, "endpoint")
+
+	responses.inc("b", "200")
+	responses.inc("a", "504")
+	responses.inc("a", "504")
+	queue.set(3, `quo"te`)
+	wait.observe(0.5, "a")
+	wait.observe(10, "a")
+	wait.observe(60, "a")
+
+	var sb strings.Builder
+	if err := r.writeText(&sb); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP responses_total Responses by code.
+# TYPE responses_total counter
+responses_total{endpoint="a",code="504"} 2
+responses_total{endpoint="b",code="200"} 1
+# HELP queue_length Queued requests.
+# TYPE queue_length gauge
+queue_length{endpoint="quo\"te"} 3
+# HELP wait_seconds Slot waits.
+# TYPE wait_seconds histogram
+wait_seconds_bucket{endpoint="a",le="1"} 1
+wait_seconds_bucket{endpoint="a",le="10"} 2
+wait_seconds_bucket{endpoint="a",le="+Inf"} 3
+wait_seconds_sum{endpoint="a"} 70.5
+wait_seconds_count{endpoint="a"} 3
+`
+	if sb.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, sb.String())
+	}
+}
@@ -0,0 +1,116 @@
+package overpass
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// minRateLimitBackoff and maxRateLimitBackoff bound how long a fixed-slot
+	// client pauses after a 429 that doesn't say how long to wait. The pause
+	// doubles with each consecutive 429.
+	minRateLimitBackoff = 5 * time.Second
+	maxRateLimitBackoff = 2 * time.Minute
+)
+
+// tokenBucket paces the requests of a client for a server with no status
+// endpoint, which has to guess at the server's limits: requests are spread out
+// at rate per second with bursts of up to burst, and pause altogether when the
+// server answers 429.
+type tokenBucket struct {
+	mu          sync.Mutex
+	rate        float64 // tokens per second; 0 for no pacing
+	burst       float64
+	tokens      float64
+	last        time.Time // when tokens was last refilled
+	pausedUntil time.Time
+	backoff     time.Duration // pause after the next 429 without Retry-After
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+		backoff: minRateLimitBackoff,
+	}
+}
+
+// wait blocks until a request may be sent, taking a token for it.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		delay := b.take(time.Now())
+		if delay == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// take takes a token if one is available at now, returning 0, or returns how
+// long to wait before trying again.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimited pauses the bucket after the server answered 429, for
+// retryAfter if the server said how long to wait, or else for an
+// exponentially growing backoff.
+func (b *tokenBucket) rateLimited(now time.Time, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pause := retryAfter
+	if pause <= 0 {
+		pause = b.backoff
+		b.backoff = min(2*b.backoff, maxRateLimitBackoff)
+	}
+	b.pausedUntil = now.Add(pause)
+	// Don't follow the pause with a burst the server just refused.
+	b.tokens = min(b.tokens, 1)
+}
+
+// succeeded resets the backoff once the server accepts a request again.
+func (b *tokenBucket) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.backoff = minRateLimitBackoff
+}
+
+// RetryAfter parses a response's Retry-After header, either delay seconds or
+// an HTTP date, into the delay from now it asks for. It returns 0 for a
+// missing, invalid or past value.
+func RetryAfter(header http.Header, now time.Time) time.Duration {
+	v := header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
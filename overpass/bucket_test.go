@@ -0,0 +1,131 @@
+package overpass
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "", expected: 0},
+		{value: "30", expected: 30 * time.Second},
+		{value: "-5", expected: 0},
+		{value: now.Add(time.Minute).Format(http.TimeFormat), expected: time.Minute},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat), expected: 0},
+		{value: "soon", expected: 0},
+	} {
+		header := http.Header{}
+		if tc.value != "" {
+			header.Set("Retry-After", tc.value)
+		}
+		if actual := RetryAfter(header, now); actual != tc.expected {
+			t.Errorf("RetryAfter(%q): expected %s, got %s", tc.value, tc.expected, actual)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(1, 2) // one a second, bursts of 2
+	b.last = now
+
+	for i := 0; i < 2; i++ {
+		if d := b.take(now); d != 0 {
+			t.Fatalf("expected the burst to be allowed at once, request %d waited %s", i+1, d)
+		}
+	}
+	if d := b.take(now); d != time.Second {
+		t.Fatalf("expected to wait a second for the next token, got %s", d)
+	}
+	if d := b.take(now.Add(time.Second)); d != 0 {
+		t.Fatalf("expected a token after a second, got a wait of %s", d)
+	}
+
+	later := now.Add(time.Hour)
+	b.rateLimited(later, 0)
+	if d := b.take(later); d != minRateLimitBackoff {
+		t.Fatalf("expected a 429 to pause for %s, got %s", minRateLimitBackoff, d)
+	}
+	b.rateLimited(later, 0)
+	if d := b.take(later); d != 2*minRateLimitBackoff {
+		t.Fatalf("expected consecutive 429s to double the pause, got %s", d)
+	}
+	b.rateLimited(later, time.Minute)
+	if d := b.take(later); d != time.Minute {
+		t.Fatalf("expected Retry-After to set the pause, got %s", d)
+	}
+	b.succeeded()
+	if b.backoff != minRateLimitBackoff {
+		t.Fatalf("expected success to reset the backoff, got %s", b.backoff)
+	}
+}
+
+// A fixed-slot client never runs more queries at once than its slots, holds
+// a slot until the response body is closed, and pauses after a 429.
+func TestClient_fixedSlots(t *testing.T) {
+	var inFlight, peak, calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"elements":[]}`))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "", 5*time.Second, WithFixedSlots(2))
+	defer c.Close()
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+
+	resp, err := c.Query(context.Background(), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the first query to be rate limited, got %d", resp.StatusCode)
+	}
+
+	start := time.Now()
+	done := make(chan error)
+	for i := 0; i < 6; i++ {
+		go func() {
+			resp, err := c.Query(context.Background(), "q")
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 6; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("expected queries to pause for the 429's Retry-After, took %s", waited)
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("expected at most 2 queries at once, got %d", p)
+	}
+}
@@ -4,10 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"net/url"
-	"strings"
 	"sync"
 	"time"
 )
@@ -16,38 +15,240 @@ import (
 // to proactively manage slot availability.
 type Client struct {
 	interpreterEndpoint string
+	statusEndpoint      string
 	httpClient          *http.Client
 	fetchStatus         func(ctx context.Context) (Status, error)
-
-	tokens      chan struct{}      // buffered channel, cap = rate limit; nil when unlimited
-	requests    chan slotRequest   // incoming slot requests
-	closeCtx    context.Context    // cancelled by Close; drives coordinator shutdown and its status fetches
-	closeCancel context.CancelFunc // cancels closeCtx
-	rateLimit   int                // cached from initial status fetch; 0 means unlimited
-	unlimited   bool               // true when server reports Rate limit: 0
+	header              http.Header // sent with every query and status request
+	fixedSlots          int         // when > 0, the status endpoint is never fetched
+	requestRate         float64     // requests per second for fixed slots; 0 for no pacing
+
+	// wrapStatusBody, when non-nil, wraps how the status body is fetched.
+	wrapStatusBody func(StatusBodyFetcher) StatusBodyFetcher
+	// shared, when non-nil, are slots shared with other clients of the
+	// server.
+	shared SharedSlots
+
+	// With fixed slots, fixedSem caps concurrent requests at fixedSlots and
+	// bucket paces them. Both are nil otherwise.
+	fixedSem chan struct{}
+	bucket   *tokenBucket
+
+	tokens      chan struct{}       // buffered channel, cap = rate limit; nil when unlimited
+	requests    chan *slotRequest   // incoming slot requests
+	cancels     chan *slotRequest   // requests given up on by their callers
+	completions chan struct{}       // queries whose slots are now cooling down; buffered, cap = rate limit
+	rejections  chan struct{}       // 429s received, contradicting the slots granted; buffered
+	credits     chan int            // cooldowns ended, by estimator generation
+	cooldowns   chan chan time.Time // shared slots given back, asking when the server frees them
+	cooldown    *cooldownEstimator  // owned by the coordinator
+	closeCtx    context.Context     // cancelled by Close; drives coordinator shutdown and its status fetches
+	closeCancel context.CancelFunc  // cancels closeCtx
+	rateLimit   int                 // cached from initial status fetch; 0 means unlimited
+	unlimited   bool                // true when server reports Rate limit: 0
+	hooks       Hooks
+	logger      *slog.Logger
+	timing      coordinatorTiming
+
+	lastStatusMu sync.Mutex
+	lastStatus   Status // latest status fetched, for Status
 
 	startOnce sync.Once
 	closeOnce sync.Once
 }
 
-// slotRequest represents a request for an API slot
-type slotRequest struct {
-	ctx    context.Context
-	result chan error
+// Hooks are optional callbacks notified of a client's rate-limiting activity.
+// They may be called from the client's coordinator goroutine or from callers of
+// Start and Query at the same time, so must be safe for concurrent use and must
+// not block.
+type Hooks struct {
+	// SlotWait is called when a request has to queue because no slot is free.
+	// pending is the number of requests now queued, and wait the time until the
+	// coordinator next expects a slot, or zero if it does not know yet.
+	SlotWait func(pending int, wait time.Duration)
+	// SlotGranted is called when a Query is granted a slot, with the time it
+	// spent waiting for it. It is not called for unlimited servers.
+	SlotGranted func(waited time.Duration)
+	// QueueLength is called whenever the number of requests queued for a slot
+	// changes.
+	QueueLength func(pending int)
+	// StatusFetched is called after every status fetch, with its error if it
+	// failed.
+	StatusFetched func(err error)
+	// Response is called when a query request completes, with the response's
+	// HTTP status code, or the error if no response was received.
+	Response func(statusCode int, err error)
+}
+
+// Trace holds callbacks for the lifecycle of individual queries, as opposed to
+// Hooks which observe a client as a whole. Attach one to a query's context with
+// WithTrace.
+type Trace struct {
+	// SlotGranted is called when the query is granted a slot, with the time it
+	// spent waiting for it. It is not called for unlimited servers.
+	SlotGranted func(waited time.Duration)
+}
+
+type traceKey struct{}
+
+// WithTrace returns a copy of ctx carrying trace, so Query calls made with it
+// report to trace.
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+func contextTrace(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+// Priority orders requests queued for a slot on a rate-limited server: higher
+// priorities are granted slots first, and requests of equal priority in the
+// order they queued. So that lower priorities are not starved, a queued
+// request's priority rises by one for every 30 seconds it waits. Fixed-slot
+// and unlimited clients grant slots in no particular order.
+type Priority int
+
+const (
+	// PriorityNormal is the priority of a query whose context carries none.
+	PriorityNormal Priority = 0
+	// PriorityHigh is for queries someone is waiting on, e.g. from a
+	// user-facing server sharing a client with batch work.
+	PriorityHigh Priority = 1
+)
+
+// Raised returns the priority above p, for a request that has already waited
+// its turn once, such as a retry, to queue ahead of fresh requests at p.
+func (p Priority) Raised() Priority {
+	return p + 1
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying priority, so slots for Query and
+// Acquire calls made with it are requested at that priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// ContextPriority returns the priority ctx carries, or PriorityNormal.
+func ContextPriority(ctx context.Context) Priority {
+	priority, _ := ctx.Value(priorityKey{}).(Priority)
+	return priority
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// WithLogger sets the logger the client reports its slot and status activity
+// to. Without it, the client logs nothing.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithHooks registers callbacks for the client's rate-limiting activity.
+func WithHooks(hooks Hooks) Option {
+	return func(c *Client) {
+		c.hooks = hooks
+	}
+}
+
+// WithHeader adds header to every query and status request, e.g. for a
+// private instance behind an authenticating proxy. Its values replace any
+// the client would otherwise send under the same keys.
+func WithHeader(header http.Header) Option {
+	return func(c *Client) {
+		for k, vs := range header {
+			c.header[http.CanonicalHeaderKey(k)] = vs
+		}
+	}
+}
+
+// WithUserAgent sets the User-Agent sent with every request. The Overpass
+// usage policy asks heavy users to include a way of contacting them.
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.header.Set("User-Agent", userAgent)
+	}
+}
+
+// WithFixedSlots configures the client for a server with no status endpoint:
+// Start fetches no status, and at most slots queries run at once. A 429 from
+// the server pauses all queries, for as long as its Retry-After asks or
+// else for a backoff that grows with each consecutive 429.
+func WithFixedSlots(slots int) Option {
+	return func(c *Client) {
+		c.fixedSlots = slots
+	}
+}
+
+// WithRequestRate paces a fixed-slot client's queries to perMinute, allowing
+// bursts of up to its slots. Without it, queries are paced only by the slots
+// and 429 backoff.
+func WithRequestRate(perMinute float64) Option {
+	return func(c *Client) {
+		c.requestRate = perMinute / 60
+	}
+}
+
+// WithStatusBody wraps how the client fetches its server's status with wrap,
+// which is passed the client's own fetcher, e.g. to record the status bodies
+// the server sends or to replay recorded ones without fetching them.
+func WithStatusBody(wrap func(fetch StatusBodyFetcher) StatusBodyFetcher) Option {
+	return func(c *Client) {
+		c.wrapStatusBody = wrap
+	}
+}
+
+// SharedSlots shares a server's slots with clients the client can't otherwise
+// coordinate with, such as clients in other processes on the same host, which
+// the server counts against the same per-IP limit.
+type SharedSlots interface {
+	// Acquire blocks until fewer than limit of the shared slots are taken,
+	// then takes one, returning a func to give it back. The server counts the
+	// slot as taken until freeAt, once its cooldown ends, so it must not be
+	// taken again before then.
+	Acquire(ctx context.Context, limit int) (release func(freeAt time.Time), err error)
+}
+
+// WithSharedSlots has the client take one of shared's slots for each query,
+// as well as its own, so that no more queries run at once across every client
+// sharing them than the server allows. Each client still learns from the
+// server's status, which is per IP, when a slot is free after its cooldown.
+func WithSharedSlots(shared SharedSlots) Option {
+	return func(c *Client) {
+		c.shared = shared
+	}
 }
 
 // NewClient creates a new rate-limited Overpass client.
 // Call Start() before using Query().
-func NewClient(interpreterEndpoint, statusEndpoint string, timeout time.Duration) *Client {
+func NewClient(interpreterEndpoint, statusEndpoint string, timeout time.Duration, opts ...Option) *Client {
 	closeCtx, closeCancel := context.WithCancel(context.Background())
-	return &Client{
+	c := &Client{
 		interpreterEndpoint: interpreterEndpoint,
+		statusEndpoint:      statusEndpoint,
 		httpClient:          &http.Client{Timeout: timeout},
-		fetchStatus:         StatusFetcher(statusEndpoint),
-		requests:            make(chan slotRequest),
-		closeCtx:            closeCtx,
-		closeCancel:         closeCancel,
+		// Overpass API usage policy expects clients to identify themselves.
+		// Requests without User-Agent may be deprioritised by the server.
+		header:      http.Header{"User-Agent": {defaultUserAgent}},
+		requests:    make(chan *slotRequest),
+		cancels:     make(chan *slotRequest),
+		closeCtx:    closeCtx,
+		closeCancel: closeCancel,
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		timing:      defaultCoordinatorTiming,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	fetchBody := statusBodyFetcher(statusEndpoint, c.header)
+	if c.wrapStatusBody != nil {
+		fetchBody = c.wrapStatusBody(fetchBody)
+	}
+	c.fetchStatus = parsingStatus(fetchBody, c.logger)
+	return c
 }
 
 // Start initializes the client by fetching the initial status and starting
@@ -59,7 +260,14 @@ func NewClient(interpreterEndpoint, statusEndpoint string, timeout time.Duration
 func (c *Client) Start(ctx context.Context) error {
 	var err error
 	c.startOnce.Do(func() {
-		status, fetchErr := c.fetchStatus(ctx)
+		if c.fixedSlots > 0 {
+			c.fixedSem = make(chan struct{}, c.fixedSlots)
+			c.bucket = newTokenBucket(c.requestRate, c.fixedSlots)
+			c.logger.Info("overpass client started: fixed slots, no status endpoint", "slots", c.fixedSlots, "requests_per_minute", c.requestRate*60)
+			return
+		}
+
+		status, fetchErr := c.refreshStatus(ctx)
 		if fetchErr != nil {
 			err = fmt.Errorf("initial status fetch: %w", fetchErr)
 			return
@@ -73,13 +281,20 @@ func (c *Client) Start(ctx context.Context) error {
 		c.rateLimit = status.RateLimit
 		// Rate limit: 0 is the Overpass convention for "no per-IP slot enforcement".
 		// In that case we skip token allocation and the coordinator goroutine entirely.
+		// A status without a rate limit fails to parse, so is never taken for it.
 		if status.RateLimit == 0 {
 			c.unlimited = true
-			log.Printf("Overpass client started: unlimited (no per-IP rate limit)")
+			c.logger.Info("overpass client started: unlimited (no per-IP rate limit)")
 			return
 		}
 
 		c.tokens = make(chan struct{}, status.RateLimit)
+		c.completions = make(chan struct{}, status.RateLimit)
+		c.rejections = make(chan struct{}, 1)
+		c.credits = make(chan int)
+		c.cooldowns = make(chan chan time.Time)
+		c.cooldown = newCooldownEstimator()
+		c.cooldown.observe(status.NextSlotWaits)
 
 		// Populate initial tokens - pending slots will be handled by coordinator
 		// when requests actually need to wait
@@ -90,11 +305,11 @@ func (c *Client) Start(ctx context.Context) error {
 		go c.coordinator()
 
 		if len(status.NextSlotWaits) > 0 {
-			log.Printf("Overpass client started: rate limit=%d, available now=%d, next slot in %s",
-				status.RateLimit, status.AvailableNow, status.NextSlotWaits[0].Round(time.Second))
+			c.logger.Info("overpass client started",
+				"rate_limit", status.RateLimit, "available_now", status.AvailableNow, "next_slot_in", status.NextSlotWaits[0].Round(time.Second))
 		} else {
-			log.Printf("Overpass client started: rate limit=%d, available now=%d",
-				status.RateLimit, status.AvailableNow)
+			c.logger.Info("overpass client started",
+				"rate_limit", status.RateLimit, "available_now", status.AvailableNow)
 		}
 	})
 	return err
@@ -111,6 +326,30 @@ func (c *Client) Unlimited() bool {
 	return c.unlimited
 }
 
+// Status returns the status the client last fetched from the server, or the
+// zero Status if it hasn't fetched one.
+func (c *Client) Status() Status {
+	c.lastStatusMu.Lock()
+	defer c.lastStatusMu.Unlock()
+	return c.lastStatus
+}
+
+// FixedSlots returns the configured number of slots of a server with no
+// status endpoint, or 0 if the server's status is used.
+func (c *Client) FixedSlots() int {
+	return c.fixedSlots
+}
+
+// Probe checks the server is responding by fetching its status. For a server
+// with no status endpoint there is nothing to check, so it always succeeds.
+func (c *Client) Probe(ctx context.Context) error {
+	if c.statusEndpoint == "" {
+		return nil
+	}
+	_, err := c.refreshStatus(ctx)
+	return err
+}
+
 // Close shuts down the client and cancels any pending requests.
 func (c *Client) Close() {
 	c.closeOnce.Do(func() {
@@ -119,214 +358,84 @@ func (c *Client) Close() {
 }
 
 // Query executes a query against the Overpass interpreter endpoint.
-// It blocks until an API slot is available, unless the client is in unlimited mode.
+// It blocks until an API slot is available, unless the client is in unlimited
+// mode, and holds the slot until the response body is closed.
 func (c *Client) Query(ctx context.Context, query string) (*http.Response, error) {
-	if !c.unlimited {
-		// Request a slot
-		result := make(chan error, 1)
-		select {
-		case c.requests <- slotRequest{ctx: ctx, result: result}:
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-c.closeCtx.Done():
-			return nil, errors.New("client closed")
-		}
-
-		// Wait for slot
-		select {
-		case err := <-result:
-			if err != nil {
-				return nil, fmt.Errorf("waiting for API slot: %w", err)
-			}
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-c.closeCtx.Done():
-			return nil, errors.New("client closed")
-		}
+	slot, err := c.Acquire(ctx)
+	if err != nil {
+		return nil, err
 	}
-
-	// Make the actual request.
-	// The Overpass API expects POST bodies as form-encoded "data=<query>".
-	// Without explicit Content-Type, the server must guess the body format.
-	body := strings.NewReader(url.Values{"data": {query}}.Encode())
-	req, err := http.NewRequestWithContext(ctx, "POST", c.interpreterEndpoint, body)
+	resp, err := slot.Do(query)
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		slot.Release()
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	// Overpass API usage policy expects clients to identify themselves.
-	// Requests without User-Agent may be deprioritised by the server.
-	req.Header.Set("User-Agent", "route-poi-finder")
-
-	return c.httpClient.Do(req)
+	resp.Body = ReleaseOnClose(resp.Body, slot.Release)
+	return resp, nil
 }
 
-// coordinator manages slot allocation and status fetching
-func (c *Client) coordinator() {
-	var pendingRequests []slotRequest
-	timerFired := make(chan struct{}, 1)
-	var timerActive bool
-	var nextSlotWait time.Duration
-	var statusRetries int
-
-	for {
-		select {
-		case req := <-c.requests:
-			// Check if context already cancelled
-			select {
-			case <-req.ctx.Done():
-				req.result <- req.ctx.Err()
-				continue
-			default:
-			}
-
-			// Try to get token immediately
-			select {
-			case <-c.tokens:
-				req.result <- nil // got slot
-			default:
-				// No token available, queue the request
-				pendingRequests = append(pendingRequests, req)
-				if timerActive {
-					log.Printf("Request queued, %d pending, timer active (wait: %s)",
-						len(pendingRequests), nextSlotWait.Round(time.Second))
-				} else {
-					log.Printf("Request queued, %d pending, no timer", len(pendingRequests))
-				}
-
-				// If no timer running, fetch status now
-				if !timerActive {
-					pendingRequests, timerActive, nextSlotWait, statusRetries = c.fetchStatusAndSchedule(
-						pendingRequests, timerFired, statusRetries)
-				}
-			}
-
-		case <-timerFired:
-			timerActive = false
-			// Timer fired - fetch fresh status and process
-			if len(pendingRequests) > 0 {
-				pendingRequests, timerActive, nextSlotWait, statusRetries = c.fetchStatusAndSchedule(
-					pendingRequests, timerFired, statusRetries)
-			}
-
-		case <-c.closeCtx.Done():
-			// Cancel all pending requests
-			for _, req := range pendingRequests {
-				req.result <- errors.New("client closed")
-			}
-			return
-		}
+// notify sends to one of the coordinator's buffered event channels without
+// blocking. An event dropped because the buffer is full only costs the
+// coordinator a status fetch.
+func (c *Client) notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
 	}
 }
 
-// fetchStatusAndSchedule fetches status, serves what it can, and schedules one timer if needed.
-// statusRetries tracks consecutive status fetch failures for exponential backoff.
-func (c *Client) fetchStatusAndSchedule(
-	pendingRequests []slotRequest,
-	timerFired chan<- struct{},
-	statusRetries int,
-) (remaining []slotRequest, timerActive bool, nextWait time.Duration, retries int) {
-	const maxStatusRetries = 3
-	// closeCtx keeps periodic status fetches bounded by the client's lifetime.
-	status, err := c.fetchStatus(c.closeCtx)
-	if err != nil {
-		if statusRetries < maxStatusRetries {
-			statusRetries++
-			backoff := time.Duration(5<<(statusRetries-1)) * time.Second // 5s, 10s, 20s
-			log.Printf("Status fetch failed (attempt %d/%d), retrying in %s: %v",
-				statusRetries, maxStatusRetries, backoff, err)
-			time.AfterFunc(backoff, func() {
-				select {
-				case timerFired <- struct{}{}:
-				default:
-				}
-			})
-			return pendingRequests, true, backoff, statusRetries
-		}
-		// Max retries exhausted, fail the oldest pending request
-		log.Printf("Status fetch failed after %d retries, failing oldest request: %v",
-			maxStatusRetries, err)
-		if len(pendingRequests) > 0 {
-			pendingRequests[0].result <- fmt.Errorf("fetching API status after %d retries: %w", maxStatusRetries, err)
-			pendingRequests = pendingRequests[1:]
-		}
-		return pendingRequests, false, 0, 0
+// fixedSlot waits for one of a fixed-slot client's slots and for the token
+// bucket to allow a request made at requested, returning a func to release
+// the slot.
+func (c *Client) fixedSlot(ctx context.Context, requested time.Time) (release func(), err error) {
+	select {
+	case c.fixedSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closeCtx.Done():
+		return nil, errors.New("client closed")
 	}
-	// Reset retry counter on success
-	statusRetries = 0
-
-	// Edge case: no slots and no wait times
-	if status.AvailableNow == 0 && len(status.NextSlotWaits) == 0 {
-		if len(pendingRequests) > 0 {
-			pendingRequests[0].result <- errors.New("no slots available and no wait times provided")
-			pendingRequests = pendingRequests[1:]
-		}
-		return pendingRequests, false, 0, statusRetries
+	release = func() { <-c.fixedSem }
+	if err := c.bucket.wait(ctx); err != nil {
+		release()
+		return nil, fmt.Errorf("waiting for API slot: %w", err)
 	}
+	c.slotGranted(ctx, time.Since(requested))
+	return release, nil
+}
 
-	if len(status.NextSlotWaits) > 0 {
-		log.Printf("Status: %d available now, next slot in %s",
-			status.AvailableNow, status.NextSlotWaits[0].Round(time.Second))
-	} else {
-		log.Printf("Status: %d available now", status.AvailableNow)
+// slotGranted reports a query being granted a slot after waiting for it.
+func (c *Client) slotGranted(ctx context.Context, waited time.Duration) {
+	if c.hooks.SlotGranted != nil {
+		c.hooks.SlotGranted(waited)
+	}
+	if trace := contextTrace(ctx); trace != nil && trace.SlotGranted != nil {
+		trace.SlotGranted(waited)
 	}
+}
 
-	// Drain any stale tokens (fresh status = fresh truth)
+// drainTokens discards every token currently held.
+func (c *Client) drainTokens() {
 	for {
 		select {
 		case <-c.tokens:
 		default:
-			goto drained
-		}
-	}
-drained:
-
-	// Add tokens for immediately available slots
-	for i := 0; i < status.AvailableNow; i++ {
-		select {
-		case c.tokens <- struct{}{}:
-		default:
-			break // buffer full
+			return
 		}
 	}
-
-	// Serve pending requests with available tokens
-	pendingRequests = c.servePendingRequests(pendingRequests)
-
-	// If still have pending requests and there's a wait time, schedule timer
-	if len(pendingRequests) > 0 && len(status.NextSlotWaits) > 0 {
-		nextWait = status.NextSlotWaits[0]
-		time.AfterFunc(nextWait, func() {
-			select {
-			case timerFired <- struct{}{}:
-			default:
-			}
-		})
-		return pendingRequests, true, nextWait, statusRetries
-	}
-
-	return pendingRequests, false, 0, statusRetries
 }
 
-// servePendingRequests attempts to serve pending requests with available tokens
-func (c *Client) servePendingRequests(pending []slotRequest) []slotRequest {
-	var remaining []slotRequest
-	for _, req := range pending {
-		// Check if context cancelled
-		select {
-		case <-req.ctx.Done():
-			req.result <- req.ctx.Err()
-			continue
-		default:
-		}
-
-		// Try to get a token
-		select {
-		case <-c.tokens:
-			req.result <- nil
-		default:
-			remaining = append(remaining, req)
-		}
+// refreshStatus fetches the server's status, reporting the fetch to the hooks
+// and keeping the status for Status.
+func (c *Client) refreshStatus(ctx context.Context) (Status, error) {
+	status, err := c.fetchStatus(ctx)
+	if c.hooks.StatusFetched != nil {
+		c.hooks.StatusFetched(err)
+	}
+	if err == nil {
+		c.lastStatusMu.Lock()
+		c.lastStatus = status
+		c.lastStatusMu.Unlock()
 	}
-	return remaining
+	return status, err
 }
@@ -0,0 +1,172 @@
+package overpass
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass/overpasstest"
+)
+
+// Once a status has shown how long slots cool down for, the client credits
+// slots back by itself rather than fetching the status for every query after
+// the initial burst. Polling alone takes 5 status fetches for these queries:
+// one at start and two for each pair of queries after the first.
+func TestClient_creditsSlotsAfterCooldown(t *testing.T) {
+	srv := overpasstest.NewServer(2, time.Second)
+	defer srv.Close()
+
+	c := NewClient(srv.InterpreterURL(), srv.StatusURL(), 5*time.Second)
+	defer c.Close()
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		resp, err := c.Query(context.Background(), "q")
+		if err != nil {
+			t.Fatalf("query %d: %v", i+1, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	stats := srv.Stats()
+	if stats.SlotRejections > 0 {
+		t.Errorf("expected no queries to be rejected, got %d", stats.SlotRejections)
+	}
+	if stats.StatusFetches > 2 {
+		t.Errorf("expected at most 2 status fetches, got %d", stats.StatusFetches)
+	}
+}
+
+func TestCooldownEstimator(t *testing.T) {
+	e := newCooldownEstimator()
+	if d := e.estimate(); d != 0 {
+		t.Fatalf("expected no estimate before any wait is observed, got %s", d)
+	}
+	e.observe([]time.Duration{2 * time.Second, 4 * time.Second})
+	e.observe([]time.Duration{time.Second})
+	if d := e.estimate(); d != 6*time.Second {
+		t.Fatalf("expected the longest wait with a margin, got %s", d)
+	}
+
+	e.outstanding = 3
+	generation := e.generation
+	e.contradicted()
+	if d := e.estimate(); d != 0 || e.outstanding != 0 || e.generation == generation {
+		t.Fatalf("expected a contradiction to drop the estimate and outstanding credits, got %s, %d", d, e.outstanding)
+	}
+	e.observe([]time.Duration{4 * time.Second})
+	if d := e.estimate(); d != 12*time.Second {
+		t.Fatalf("expected the margin to widen after a contradiction, got %s", d)
+	}
+}
+
+// A slot can be used for a request to any of the server's endpoints, which
+// carries the client's headers, and is freed for the next caller on release.
+func TestSlot_DoRequest(t *testing.T) {
+	var userAgent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "", time.Second, WithFixedSlots(1), WithUserAgent("tester"))
+	defer c.Close()
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	slot, err := c.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", srv.URL+"/api/timestamp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := slot.DoRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if userAgent != "tester" {
+		t.Errorf("expected the client's User-Agent, got %q", userAgent)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Acquire(ctx); err == nil {
+		t.Fatal("expected the only slot to be held until released")
+	}
+	slot.Release()
+	slot.Release()
+	next, err := c.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("expected the released slot to be granted, got %v", err)
+	}
+	next.Release()
+}
+
+// semaphoreSlots are SharedSlots of a fixed number, for clients in one process.
+type semaphoreSlots chan struct{}
+
+func (s semaphoreSlots) Acquire(ctx context.Context, _ int) (func(time.Time), error) {
+	select {
+	case s <- struct{}{}:
+		return func(freeAt time.Time) {
+			time.AfterFunc(time.Until(freeAt), func() { <-s })
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Clients sharing slots run no more queries at once between them than the
+// server allows, where each alone would take every slot it was told was free,
+// nor take a slot still cooling down after another's query.
+func TestClient_sharedSlots(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cooldown time.Duration
+	}{
+		{name: "no cooldown"},
+		{name: "cooldown", cooldown: 100 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := overpasstest.NewServer(2, tc.cooldown)
+			defer srv.Close()
+			srv.Respond("", overpasstest.Response{Body: []byte(`{"elements":[]}`), Delay: 50 * time.Millisecond})
+
+			shared := make(semaphoreSlots, 2)
+			var wg sync.WaitGroup
+			for range 2 {
+				c := NewClient(srv.InterpreterURL(), srv.StatusURL(), 5*time.Second, WithSharedSlots(shared))
+				defer c.Close()
+				if err := c.Start(context.Background()); err != nil {
+					t.Fatalf("starting client: %v", err)
+				}
+				for range 3 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						resp, err := c.Query(context.Background(), "q")
+						if err != nil {
+							t.Errorf("query: %v", err)
+							return
+						}
+						_, _ = io.Copy(io.Discard, resp.Body)
+						_ = resp.Body.Close()
+					}()
+				}
+			}
+			wg.Wait()
+			if stats := srv.Stats(); stats.SlotRejections != 0 || stats.PeakRunning > 2 {
+				t.Errorf("expected at most 2 queries at once and no rejections, got %+v", stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package overpass
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// initialCooldownMargin scales the longest observed slot wait into a
+	// cooldown estimate. It doubles, up to maxCooldownMargin, each time an
+	// estimate is contradicted by a 429.
+	initialCooldownMargin = 1.5
+	maxCooldownMargin     = 6
+)
+
+// cooldownEstimator estimates how long a slot stays occupied after a query
+// completes, so the coordinator can return the slot's token by itself rather
+// than fetching the server's status to find out.
+//
+// A slot's remaining cooldown is never more than the full cooldown of a query
+// that completed just before a status fetch, so the longest wait seen in any
+// status, scaled by a safety margin, is a conservative estimate. It is only
+// used once a status has reported a wait, and is dropped as soon as the
+// server rejects a query, until a fresh status provides another.
+//
+// It is owned by the coordinator goroutine, so it needs no locking.
+type cooldownEstimator struct {
+	longest time.Duration // longest slot wait since the last contradiction
+	margin  float64
+	// generation is incremented on each contradiction, so credits scheduled
+	// from a contradicted estimate can be told apart and ignored.
+	generation int
+	// outstanding is the number of credits scheduled in the current
+	// generation and yet to arrive.
+	outstanding int
+	// due is when the last credit scheduled in the current generation
+	// arrives.
+	due time.Time
+	// published is the estimate, for reading outside the coordinator.
+	published atomic.Int64
+}
+
+func newCooldownEstimator() *cooldownEstimator {
+	return &cooldownEstimator{margin: initialCooldownMargin}
+}
+
+// observe records the slot waits reported by a status.
+func (e *cooldownEstimator) observe(waits []time.Duration) {
+	for _, w := range waits {
+		e.longest = max(e.longest, w)
+	}
+	e.published.Store(int64(e.estimate()))
+}
+
+// estimate returns how long after a query completes its slot should be
+// credited back, or 0 when there is nothing to base an estimate on.
+func (e *cooldownEstimator) estimate() time.Duration {
+	return time.Duration(float64(e.longest) * e.margin)
+}
+
+// current returns the estimate as of the coordinator's last update of it. It
+// is safe to call from any goroutine.
+func (e *cooldownEstimator) current() time.Duration {
+	return time.Duration(e.published.Load())
+}
+
+// supersede drops the outstanding credits, when a fresh status is about to
+// reschedule them.
+func (e *cooldownEstimator) supersede() {
+	e.generation++
+	e.outstanding = 0
+	e.due = time.Time{}
+}
+
+// contradicted discards the estimate and every outstanding credit after the
+// server rejected a query, and widens the margin for the next estimate.
+func (e *cooldownEstimator) contradicted() {
+	e.longest = 0
+	e.margin = min(2*e.margin, maxCooldownMargin)
+	e.published.Store(0)
+	e.supersede()
+}
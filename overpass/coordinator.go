@@ -0,0 +1,379 @@
+package overpass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// slotRequest represents a request for an API slot
+type slotRequest struct {
+	ctx      context.Context
+	priority Priority
+	queued   time.Time
+	result   chan error // buffered, so the coordinator never blocks on it
+	// granted is set once the request has a slot. It is only touched by the
+	// coordinator.
+	granted bool
+}
+
+// coordinatorState is what the coordinator waits on to serve its queued
+// requests.
+type coordinatorState int
+
+const (
+	// stateIdle: no requests are queued.
+	stateIdle coordinatorState = iota
+	// stateAwaitingCredits: requests are queued for slots the coordinator
+	// expects to be credited back, from completed queries' estimated
+	// cooldowns or a status's slot waits. The re-drive timer is armed for
+	// after the last credit is due, in case it never comes.
+	stateAwaitingCredits
+	// stateAwaitingStatus: requests are queued, no slot is due back, and the
+	// re-drive timer is armed for the next status fetch.
+	stateAwaitingStatus
+)
+
+func (s coordinatorState) String() string {
+	switch s {
+	case stateIdle:
+		return "idle"
+	case stateAwaitingCredits:
+		return "awaiting credits"
+	case stateAwaitingStatus:
+		return "awaiting status"
+	}
+	return fmt.Sprintf("coordinatorState(%d)", int(s))
+}
+
+// maxStatusRetries is how many consecutive status fetches may fail before the
+// coordinator fails every queued request.
+const maxStatusRetries = 3
+
+// coordinatorTiming are the delays the coordinator waits between status
+// fetches.
+type coordinatorTiming struct {
+	// statusRetry is the backoff after the first failed status fetch,
+	// doubling with each consecutive failure.
+	statusRetry time.Duration
+	// poll and maxPoll bound the backoff between status fetches while no slot
+	// is free and the status says nothing of when one will be, e.g. while
+	// every slot is running a query. It doubles with each such status.
+	poll, maxPoll time.Duration
+	// slack is added to the slot waits a status reports, which are rounded
+	// to whole seconds, before crediting the slots back, and to when the last
+	// credit is due before the re-drive timer gives up on it.
+	slack time.Duration
+	// aging is how long a queued request waits for its priority to rise by
+	// one.
+	aging time.Duration
+}
+
+var defaultCoordinatorTiming = coordinatorTiming{
+	statusRetry: 5 * time.Second,
+	poll:        time.Second,
+	maxPoll:     30 * time.Second,
+	slack:       time.Second,
+	aging:       30 * time.Second,
+}
+
+// coordinator grants a rate-limited client's slot requests by priority, then
+// in the order they arrive, as slots become free. It is a small state machine: after every
+// event it serves what it can, then settles into a coordinatorState. Whenever
+// a request is left queued the re-drive timer is armed, so no request can be
+// stranded waiting on an event that never comes.
+type coordinator struct {
+	c *Client
+
+	state          coordinatorState
+	queue          []*slotRequest // in the order they arrived
+	redrive        *time.Timer
+	statusFailures int // consecutive failed status fetches
+	polls          int // consecutive statuses with no slot free or due
+	nextSlotWait   time.Duration
+}
+
+// coordinator manages slot allocation and status fetching
+func (c *Client) coordinator() {
+	co := &coordinator{c: c, redrive: time.NewTimer(time.Hour)}
+	co.redrive.Stop()
+	reportedPending := 0
+
+	for {
+		if c.hooks.QueueLength != nil && len(co.queue) != reportedPending {
+			reportedPending = len(co.queue)
+			c.hooks.QueueLength(reportedPending)
+		}
+		select {
+		case req := <-c.requests:
+			if err := req.ctx.Err(); err != nil {
+				req.result <- err
+				continue
+			}
+			co.queue = append(co.queue, req)
+			co.step(false)
+			if !req.granted {
+				c.logger.Debug("request queued", "pending", len(co.queue), "state", co.state, "wait", co.nextSlotWait.Round(time.Second))
+				if c.hooks.SlotWait != nil {
+					c.hooks.SlotWait(len(co.queue), co.nextSlotWait)
+				}
+			}
+
+		case req := <-c.cancels:
+			if i := slices.Index(co.queue, req); i >= 0 {
+				co.queue = slices.Delete(co.queue, i, i+1)
+				req.result <- req.ctx.Err()
+			} else if req.granted {
+				// The slot was granted as its caller gave up, so was never
+				// used: pass it on.
+				select {
+				case c.tokens <- struct{}{}:
+				default:
+				}
+			}
+			co.step(false)
+
+		case <-c.completions:
+			if wait := c.cooldown.estimate(); wait > 0 {
+				c.scheduleCredit(wait)
+			}
+			co.step(false)
+
+		case generation := <-c.credits:
+			if generation != c.cooldown.generation {
+				continue // superseded by a status fetch or contradicted
+			}
+			c.cooldown.outstanding--
+			select {
+			case c.tokens <- struct{}{}:
+			default:
+			}
+			co.step(false)
+
+		case reply := <-c.cooldowns:
+			co.cooledDown(reply)
+
+		case <-c.rejections:
+			c.logger.Debug("slot cooldown estimate contradicted by server, falling back to status")
+			c.cooldown.contradicted()
+			co.step(false)
+
+		case <-co.redrive.C:
+			if co.state == stateAwaitingCredits {
+				// The credits are overdue, so take them as lost and let
+				// the status account for their slots.
+				c.cooldown.supersede()
+			}
+			co.step(true)
+
+		case <-c.closeCtx.Done():
+			co.redrive.Stop()
+			// Cancel all pending requests
+			co.fail(errors.New("client closed"))
+			return
+		}
+	}
+}
+
+// step serves queued requests with the tokens available, fetching the status
+// first if forced or if nothing else will free a slot, then settles into the
+// state for what is left queued.
+func (co *coordinator) step(fetch bool) {
+	c := co.c
+	co.serve()
+	if len(co.queue) > 0 && c.cooldown.outstanding == 0 && co.state != stateAwaitingStatus {
+		fetch = true
+	}
+	var poll time.Duration
+	if len(co.queue) > 0 && fetch {
+		poll = co.fetchStatus()
+		co.serve()
+	}
+	co.settle(fetch, poll)
+}
+
+// settle puts the coordinator into the state for what is left queued, given
+// whether it has just fetched the status and, if so, how long that said to
+// wait before fetching it again.
+func (co *coordinator) settle(fetched bool, poll time.Duration) {
+	c := co.c
+	switch {
+	case len(co.queue) == 0:
+		co.state = stateIdle
+		co.redrive.Stop()
+	case c.cooldown.outstanding > 0:
+		co.state = stateAwaitingCredits
+		co.redrive.Reset(time.Until(c.cooldown.due) + c.timing.slack)
+	case fetched:
+		co.state = stateAwaitingStatus
+		co.redrive.Reset(poll)
+	default:
+		// Already awaiting a status fetch, with the timer armed for it.
+	}
+}
+
+// fetchStatus fetches the status, turning the slots it reports free into
+// tokens and crediting back each cooling slot when the status says it will be
+// free. It returns how long to wait before fetching the status again, should
+// no slot be due back. After maxStatusRetries consecutive failures every
+// queued request fails.
+func (co *coordinator) fetchStatus() (poll time.Duration) {
+	c := co.c
+	// closeCtx keeps periodic status fetches bounded by the client's lifetime.
+	status, err := c.refreshStatus(c.closeCtx)
+	if err != nil {
+		co.statusFailures++
+		if co.statusFailures > maxStatusRetries {
+			c.logger.Warn("status fetch failed after retries, failing queued requests",
+				"retries", maxStatusRetries, "pending", len(co.queue), "err", err)
+			co.fail(fmt.Errorf("fetching API status after %d retries: %w", maxStatusRetries, err))
+			co.statusFailures = 0
+			return 0
+		}
+		backoff := c.timing.statusRetry << (co.statusFailures - 1) // 5s, 10s, 20s
+		c.logger.Warn("status fetch failed, retrying",
+			"attempt", co.statusFailures, "max", maxStatusRetries, "backoff", backoff, "err", err)
+		co.nextSlotWait = backoff
+		return backoff
+	}
+	co.statusFailures = 0
+
+	if len(status.NextSlotWaits) > 0 {
+		c.logger.Debug("status fetched",
+			"available_now", status.AvailableNow, "next_slot_in", status.NextSlotWaits[0].Round(time.Second))
+	} else {
+		c.logger.Debug("status fetched", "available_now", status.AvailableNow, "running", len(status.RunningQueries))
+	}
+
+	// Drain any stale tokens (fresh status = fresh truth)
+	c.drainTokens()
+
+	// Add tokens for immediately available slots, no more than there are
+	// slots however many the status reports.
+	for range min(status.AvailableNow, cap(c.tokens)) {
+		c.tokens <- struct{}{}
+	}
+
+	// The status accounts for every slot, so it supersedes the credits
+	// already scheduled: credit each cooling slot back when the status says
+	// it is free, and estimate cooldowns from the waits it reports.
+	c.cooldown.observe(status.NextSlotWaits)
+	c.cooldown.supersede()
+	for _, wait := range status.NextSlotWaits {
+		c.scheduleCredit(wait + c.timing.slack)
+	}
+
+	if status.AvailableNow > 0 || len(status.NextSlotWaits) > 0 {
+		co.polls = 0
+		co.nextSlotWait = 0
+		if len(status.NextSlotWaits) > 0 {
+			co.nextSlotWait = status.NextSlotWaits[0]
+		}
+		return c.timing.poll
+	}
+	// No slot is free or says when it will be, e.g. every slot is running a
+	// query: look again later, backing off while nothing changes.
+	poll = min(c.timing.poll<<min(co.polls, 16), c.timing.maxPoll)
+	co.polls++
+	co.nextSlotWait = poll
+	return poll
+}
+
+// cooledDown answers reply, from a shared slot given back, with when the
+// server frees the slot, along with every other such request already waiting.
+// With no cooldown estimate it fetches the status for them all, so a burst of
+// slots given back costs one fetch rather than one each, and the fresh status
+// serves the queue as any other would. Should the fetch fail, the slots are
+// taken as free now.
+func (co *coordinator) cooledDown(reply chan time.Time) {
+	c := co.c
+	replies := []chan time.Time{reply}
+	for waiting := true; waiting; {
+		select {
+		case r := <-c.cooldowns:
+			replies = append(replies, r)
+		default:
+			waiting = false
+		}
+	}
+	if c.cooldown.estimate() == 0 {
+		poll := co.fetchStatus()
+		co.serve()
+		co.settle(true, poll)
+	}
+	// A fetch that failed leaves the estimate at 0, so free now.
+	freeAt := time.Now().Add(c.cooldown.estimate())
+	for _, r := range replies {
+		r <- freeAt
+	}
+}
+
+// serve grants queued requests slots while there are tokens, highest
+// priority first, then oldest.
+func (co *coordinator) serve() {
+	c := co.c
+	co.queue = slices.DeleteFunc(co.queue, func(req *slotRequest) bool {
+		err := req.ctx.Err()
+		if err != nil {
+			req.result <- err
+		}
+		return err != nil
+	})
+	now := time.Now()
+	for len(co.queue) > 0 {
+		select {
+		case <-c.tokens:
+		default:
+			return
+		}
+		i := co.next(now)
+		req := co.queue[i]
+		co.queue = slices.Delete(co.queue, i, i+1)
+		req.granted = true
+		req.result <- nil
+	}
+}
+
+// next returns the index of the queued request to grant a slot next: the one
+// whose priority, raised by one for each aging period it has waited, is
+// highest. Of equals the oldest, which comes first, wins.
+func (co *coordinator) next(now time.Time) int {
+	next, highest := 0, 0.0
+	for i, req := range co.queue {
+		aged := float64(req.priority) + float64(now.Sub(req.queued))/float64(co.c.timing.aging)
+		if i == 0 || aged > highest {
+			next, highest = i, aged
+		}
+	}
+	return next
+}
+
+// fail fails every queued request with err.
+func (co *coordinator) fail(err error) {
+	for _, req := range co.queue {
+		req.result <- err
+	}
+	co.queue = nil
+}
+
+// scheduleCredit returns a slot's token to the coordinator after wait.
+func (c *Client) scheduleCredit(wait time.Duration) {
+	c.cooldown.outstanding++
+	c.cooldown.due = later(c.cooldown.due, time.Now().Add(wait))
+	generation := c.cooldown.generation
+	time.AfterFunc(wait, func() {
+		select {
+		case c.credits <- generation:
+		case <-c.closeCtx.Done():
+		}
+	})
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
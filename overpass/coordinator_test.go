@@ -0,0 +1,307 @@
+package overpass
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testCoordinatorTiming = coordinatorTiming{
+	statusRetry: 2 * time.Millisecond,
+	poll:        time.Millisecond,
+	maxPoll:     10 * time.Millisecond,
+	slack:       time.Millisecond,
+	aging:       time.Hour,
+}
+
+// startStubbedClient starts a rate-limited client whose statuses come from
+// fetch rather than a server.
+func startStubbedClient(t *testing.T, rateLimit int, fetch func() (Status, error), opts ...Option) *Client {
+	t.Helper()
+	c := NewClient("", "", time.Second, opts...)
+	c.timing = testCoordinatorTiming
+	started := false
+	c.fetchStatus = func(context.Context) (Status, error) {
+		// Start fetches the initial status, and from then on only the
+		// coordinator does.
+		if !started {
+			started = true
+			return Status{RateLimit: rateLimit}, nil
+		}
+		return fetch()
+	}
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// However the status answers, every request for a slot resolves: it is
+// granted, fails, or is cancelled by its caller, and never left queued with
+// nothing to drive it.
+func TestCoordinator_neverStrandsRequests(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		// The status stub has its own rng, as only the coordinator calls
+		// it, one fetch at a time.
+		rng, statusRng := rand.New(rand.NewSource(seed)), rand.New(rand.NewSource(-seed))
+		const rateLimit = 3
+		fetch := func() (Status, error) {
+			switch statusRng.Intn(6) {
+			case 0:
+				return Status{}, errors.New("status unavailable")
+			case 1:
+				// Every slot running a query: nothing free or cooling down.
+				return Status{RateLimit: rateLimit, RunningQueries: make([]RunningQuery, rateLimit)}, nil
+			}
+			s := Status{RateLimit: rateLimit, AvailableNow: statusRng.Intn(rateLimit + 1)}
+			for range statusRng.Intn(rateLimit - s.AvailableNow + 1) {
+				s.NextSlotWaits = append(s.NextSlotWaits, time.Duration(statusRng.Intn(5))*time.Millisecond)
+			}
+			return s, nil
+		}
+		c := startStubbedClient(t, rateLimit, fetch)
+
+		const requests = 40
+		var wg sync.WaitGroup
+		resolved := make(chan struct{}, requests)
+		for range requests {
+			cancelAfter := time.Duration(rng.Intn(40)) * time.Millisecond
+			cancels, rejected := rng.Intn(4) == 0, rng.Intn(8) == 0
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { resolved <- struct{}{} }()
+				ctx := context.Background()
+				if cancels {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, cancelAfter)
+					defer cancel()
+				}
+				slot, err := c.Acquire(ctx)
+				if err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+				if rejected {
+					slot.rejected = true
+					c.notify(c.rejections)
+				}
+				slot.Release()
+			}()
+		}
+		deadline := time.After(10 * time.Second)
+		for i := range requests {
+			select {
+			case <-resolved:
+			case <-deadline:
+				t.Fatalf("seed %d: %d of %d requests stranded", seed, requests-i, requests)
+			}
+		}
+		wg.Wait()
+		c.Close()
+	}
+}
+
+// oneSlotAtATime returns a status stub for a client with a single slot,
+// reporting it free once after each call to free.
+func oneSlotAtATime() (fetch func() (Status, error), free func()) {
+	var mu sync.Mutex
+	available := 0
+	fetch = func() (Status, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		s := Status{RateLimit: 1, AvailableNow: available}
+		available = 0
+		return s, nil
+	}
+	free = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		available = 1
+	}
+	return fetch, free
+}
+
+// queueSlotRequests has c's coordinator queue a request for a slot with each
+// of ctxs in turn, waiting on queued, its QueueLength hook, for each to be
+// queued before the next. The index of each request is sent to granted once
+// it has a slot, which it releases at once, or its error to errs.
+func queueSlotRequests(c *Client, queued <-chan int, ctxs ...context.Context) (granted <-chan int, errs <-chan error) {
+	grantedc, errsc := make(chan int, len(ctxs)), make(chan error, len(ctxs))
+	for i, ctx := range ctxs {
+		go func() {
+			slot, err := c.Acquire(ctx)
+			if err != nil {
+				errsc <- err
+				return
+			}
+			grantedc <- i
+			slot.Release()
+		}()
+		for n := range queued {
+			if n == i+1 {
+				break
+			}
+		}
+	}
+	return grantedc, errsc
+}
+
+// expectGrants frees c's one slot for each request in want in turn, expecting
+// them to be granted it in that order.
+func expectGrants(t *testing.T, free func(), granted <-chan int, want ...int) {
+	t.Helper()
+	for _, want := range want {
+		free()
+		select {
+		case got := <-granted:
+			if got != want {
+				t.Fatalf("expected request %d to be granted next, got %d", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %d never granted", want)
+		}
+	}
+}
+
+// Queued requests are granted slots in the order they asked for them, passing
+// over those whose callers gave up.
+func TestCoordinator_grantsInOrder(t *testing.T) {
+	fetch, free := oneSlotAtATime()
+	queued := make(chan int, 10)
+	c := startStubbedClient(t, 1, fetch, WithHooks(Hooks{QueueLength: func(n int) { queued <- n }}))
+
+	ctx := context.Background()
+	cancelled, cancel := context.WithCancel(ctx)
+	defer cancel()
+	granted, errs := queueSlotRequests(c, queued, ctx, cancelled, ctx)
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled request to fail with context.Canceled, got %v", err)
+	}
+	expectGrants(t, free, granted, 0, 2)
+}
+
+// Queued requests are granted slots by priority, then in the order they asked
+// for them.
+func TestCoordinator_grantsByPriority(t *testing.T) {
+	fetch, free := oneSlotAtATime()
+	queued := make(chan int, 10)
+	c := startStubbedClient(t, 1, fetch, WithHooks(Hooks{QueueLength: func(n int) { queued <- n }}))
+
+	normal := context.Background()
+	high := WithPriority(normal, PriorityHigh)
+	granted, _ := queueSlotRequests(c, queued, normal, high, normal, high)
+	expectGrants(t, free, granted, 1, 3, 0, 2)
+}
+
+// A request's priority rises as it waits, so a steady stream of higher
+// priority requests cannot starve it.
+func TestCoordinator_next(t *testing.T) {
+	now := time.Now()
+	co := &coordinator{c: &Client{timing: defaultCoordinatorTiming}}
+	aging := co.c.timing.aging
+	for _, tc := range []struct {
+		name  string
+		queue []*slotRequest
+		want  int
+	}{{
+		name: "higher priority",
+		queue: []*slotRequest{
+			{priority: PriorityNormal, queued: now.Add(-aging / 2)},
+			{priority: PriorityHigh, queued: now},
+		},
+		want: 1,
+	}, {
+		name: "equal priority",
+		queue: []*slotRequest{
+			{priority: PriorityHigh, queued: now.Add(-time.Second)},
+			{priority: PriorityHigh, queued: now},
+		},
+		want: 0,
+	}, {
+		name: "aged past higher priority",
+		queue: []*slotRequest{
+			{priority: PriorityHigh, queued: now.Add(-aging)},
+			{priority: PriorityNormal, queued: now.Add(-3 * aging)},
+			{priority: PriorityHigh, queued: now},
+		},
+		want: 1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			co.queue = tc.queue
+			if got := co.next(now); got != tc.want {
+				t.Errorf("expected request %d next, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+// Shared slots given back together, with no cooldown estimate to go on, share
+// a status fetch to find out when the server frees them, rather than fetching
+// it once each.
+func TestCoordinator_coalescesCooldownFetches(t *testing.T) {
+	const slots = 4
+	var mu sync.Mutex
+	fetches := 0
+	gate := make(chan struct{})
+	close(gate)
+	fetching := make(chan struct{}, slots)
+	fetch := func() (Status, error) {
+		mu.Lock()
+		fetches++
+		g := gate
+		mu.Unlock()
+		fetching <- struct{}{}
+		<-g
+		// No slot waits, so no estimate.
+		return Status{RateLimit: slots, AvailableNow: slots}, nil
+	}
+	shared := make(semaphoreSlots, slots)
+	c := startStubbedClient(t, slots, fetch, WithSharedSlots(shared))
+
+	var held []*Slot
+	for range slots {
+		slot, err := c.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("acquiring slot: %v", err)
+		}
+		held = append(held, slot)
+	}
+	mu.Lock()
+	before := fetches
+	gate = make(chan struct{})
+	mu.Unlock()
+	for len(fetching) > 0 {
+		<-fetching
+	}
+
+	// Hold the first release's fetch until the others are waiting on it.
+	for _, slot := range held {
+		slot.Release()
+	}
+	<-fetching
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	close(gate)
+	mu.Unlock()
+
+	deadline := time.After(5 * time.Second)
+	for len(shared) > 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("%d shared slots never given back", len(shared))
+		case <-time.After(time.Millisecond):
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n := fetches - before; n > 2 {
+		t.Errorf("expected the %d slots given back to share at most 2 status fetches, got %d", slots, n)
+	}
+}
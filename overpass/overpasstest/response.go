@@ -0,0 +1,82 @@
+package overpasstest
+
+import (
+	"embed"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// Response is a canned answer to a query.
+type Response struct {
+	StatusCode int // 0 for 200
+	Header     http.Header
+	Body       []byte
+	// Delay is how long the query runs, holding its slot, before the
+	// response is sent.
+	Delay time.Duration
+}
+
+// Fixture returns a 200 response with the body of the named fixture:
+//
+//   - "elements": a couple of nodes
+//   - "empty": no elements
+//   - "remark_timeout": a node, with a remark reporting the query timed out
+//   - "remark_out_of_memory": no elements, with a remark reporting the query
+//     ran out of memory
+//
+// It panics if there is no such fixture.
+func Fixture(name string) Response {
+	body, err := fixtures.ReadFile("fixtures/" + name + ".json")
+	if err != nil {
+		panic("overpasstest: " + err.Error())
+	}
+	return Response{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   body,
+	}
+}
+
+// StatusFixture returns the body of the named status fixture, for
+// Server.SetStatus:
+//
+//   - "maintenance": an HTML maintenance page, as served by a proxy in front
+//     of a server that is down
+//
+// It panics if there is no such fixture.
+func StatusFixture(name string) string {
+	body, err := fixtures.ReadFile("fixtures/status_" + name + ".html")
+	if err != nil {
+		panic("overpasstest: " + err.Error())
+	}
+	return string(body)
+}
+
+// TooManyRequests returns a 429 response, with a Retry-After header if
+// retryAfter is positive.
+func TooManyRequests(retryAfter time.Duration) Response {
+	resp := Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	if retryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	}
+	return resp
+}
+
+// GatewayTimeout returns a 504 response, as the real server's proxy sends when
+// it is overloaded.
+func GatewayTimeout() Response {
+	return Response{StatusCode: http.StatusGatewayTimeout}
+}
+
+func writeResponse(w http.ResponseWriter, resp Response) {
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	if resp.StatusCode != 0 {
+		w.WriteHeader(resp.StatusCode)
+	}
+	_, _ = w.Write(resp.Body)
+}
@@ -0,0 +1,252 @@
+// Package overpasstest provides a fake Overpass API server for testing
+// clients offline.
+//
+// A Server simulates the server's per-IP slots: each query takes a slot while
+// it runs and the slot cools down for a while after, and a query arriving
+// with no slot free is rejected with 429, as the real server does. The status
+// endpoint reports the slots in the real server's format. Queries are answered
+// from fixture responses, which can also script 429s, 504s and responses
+// whose remark reports a runtime error; the status endpoint can be made to
+// serve a malformed body.
+package overpasstest
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats counts a Server's traffic.
+type Stats struct {
+	Queries        int // queries received, including rejected ones
+	StatusFetches  int
+	SlotRejections int // queries rejected with 429 for want of a free slot
+	PeakRunning    int // most queries running at once
+}
+
+// Server is a fake Overpass API server, serving the interpreter at
+// /api/interpreter and the status at /api/status.
+type Server struct {
+	*httptest.Server
+
+	rateLimit int
+	cooldown  time.Duration
+
+	mu         sync.Mutex
+	slots      map[string][]slot // per client IP
+	running    int
+	nextPID    int
+	rules      []rule
+	statusBody string // served as the status instead of the slots, if set
+	stats      Stats
+}
+
+type slot struct {
+	running  bool
+	pid      int
+	started  time.Time
+	freeAt   time.Time // when the slot's cooldown ends
+	clientIP string
+}
+
+// rule answers queries containing match with responses in turn, repeating the
+// last.
+type rule struct {
+	match     string
+	responses []Response
+}
+
+// NewServer starts a Server allowing each client IP rateLimit queries at
+// once, each followed by cooldown before its slot is free again. A rateLimit
+// of 0 reports no per-IP limit and never rejects a query. Queries are
+// answered with Fixture("elements") unless Respond says otherwise. The caller
+// must call Close when finished.
+func NewServer(rateLimit int, cooldown time.Duration) *Server {
+	s := &Server{
+		rateLimit: rateLimit,
+		cooldown:  cooldown,
+		slots:     make(map[string][]slot),
+		nextPID:   1000,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/interpreter", s.interpreter)
+	mux.HandleFunc("/api/status", s.status)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// InterpreterURL returns the URL of the server's interpreter endpoint.
+func (s *Server) InterpreterURL() string { return s.URL + "/api/interpreter" }
+
+// StatusURL returns the URL of the server's status endpoint.
+func (s *Server) StatusURL() string { return s.URL + "/api/status" }
+
+// Respond answers queries containing match, or every query if match is
+// empty, with responses in turn, repeating the last. Rules are tried in the
+// order they were added.
+func (s *Server) Respond(match string, responses ...Response) {
+	if len(responses) == 0 {
+		panic("overpasstest: Respond needs at least one response")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = append(s.rules, rule{match: match, responses: responses})
+}
+
+// SetStatus makes the status endpoint serve body instead of reporting the
+// slots, e.g. StatusFixture("maintenance"). An empty body restores the
+// report.
+func (s *Server) SetStatus(body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusBody = body
+}
+
+// Stats returns the server's traffic so far.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *Server) interpreter(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("data")
+	ip := clientIP(r)
+
+	s.mu.Lock()
+	s.stats.Queries++
+	i, ok := s.takeSlot(ip, time.Now())
+	if !ok {
+		s.stats.SlotRejections++
+		s.mu.Unlock()
+		writeResponse(w, TooManyRequests(0))
+		return
+	}
+	s.running++
+	s.stats.PeakRunning = max(s.stats.PeakRunning, s.running)
+	resp := s.nextResponse(query)
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(resp.Delay):
+	case <-r.Context().Done():
+	}
+	writeResponse(w, resp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	if i >= 0 {
+		sl := &s.slots[ip][i]
+		sl.running = false
+		// Only a query the server ran leaves its slot cooling down.
+		if resp.StatusCode == 0 || resp.StatusCode == http.StatusOK {
+			sl.freeAt = time.Now().Add(s.cooldown)
+		}
+	}
+}
+
+// takeSlot takes a free slot of ip's at now, returning its index, or -1 when
+// there is no limit. It must be called with s.mu held.
+func (s *Server) takeSlot(ip string, now time.Time) (int, bool) {
+	if s.rateLimit == 0 {
+		return -1, true
+	}
+	slots, ok := s.slots[ip]
+	if !ok {
+		slots = make([]slot, s.rateLimit)
+		s.slots[ip] = slots
+	}
+	for i := range slots {
+		if !slots[i].running && !slots[i].freeAt.After(now) {
+			s.nextPID++
+			slots[i] = slot{running: true, pid: s.nextPID, started: now, clientIP: ip}
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// nextResponse returns the response for query. It must be called with s.mu
+// held.
+func (s *Server) nextResponse(query string) Response {
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !strings.Contains(query, r.match) {
+			continue
+		}
+		resp := r.responses[0]
+		if len(r.responses) > 1 {
+			r.responses = r.responses[1:]
+		}
+		return resp
+	}
+	return Fixture("elements")
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.StatusFetches++
+	if s.statusBody != "" {
+		_, _ = fmt.Fprint(w, s.statusBody)
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Connected as: %d\n", ipNumber(ip))
+	fmt.Fprintf(&sb, "Current time: %s\n", now.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&sb, "Announced endpoint: none\n")
+	fmt.Fprintf(&sb, "Rate limit: %d\n", s.rateLimit)
+	slots := s.slots[ip]
+	available := s.rateLimit - len(slots)
+	var waits, running []string
+	for _, sl := range slots {
+		switch {
+		case sl.running:
+			running = append(running, fmt.Sprintf("%d\t536870912\t180\t%s", sl.pid, sl.started.UTC().Format(time.RFC3339)))
+		case sl.freeAt.After(now):
+			waits = append(waits, fmt.Sprintf("Slot available after: %s, in %d seconds.",
+				sl.freeAt.UTC().Format(time.RFC3339), int(math.Ceil(sl.freeAt.Sub(now).Seconds()))))
+		default:
+			available++
+		}
+	}
+	if s.rateLimit > 0 {
+		fmt.Fprintf(&sb, "%d slots available now.\n", available)
+	}
+	for _, wait := range waits {
+		sb.WriteString(wait + "\n")
+	}
+	sb.WriteString("Currently running queries (pid, space limit, time limit, start time):\n")
+	for _, q := range running {
+		sb.WriteString(q + "\n")
+	}
+	_, _ = fmt.Fprint(w, sb.String())
+}
+
+// clientIP returns the IP the server identifies r's client by.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ipNumber renders ip as the number the real server reports it as.
+func ipNumber(ip string) uint32 {
+	v4 := net.ParseIP(ip).To4()
+	if v4 == nil {
+		return 0
+	}
+	return uint32(v4[0])<<24 | uint32(v4[1])<<16 | uint32(v4[2])<<8 | uint32(v4[3])
+}
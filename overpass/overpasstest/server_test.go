@@ -0,0 +1,95 @@
+package overpasstest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+)
+
+func query(t *testing.T, s *Server, q string) (int, string) {
+	t.Helper()
+	resp, err := http.PostForm(s.InterpreterURL(), url.Values{"data": {q}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServer_slots(t *testing.T) {
+	s := NewServer(1, time.Hour)
+	defer s.Close()
+	fetchStatus := overpass.StatusFetcher(s.StatusURL())
+
+	status, err := fetchStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RateLimit != 1 || status.AvailableNow != 1 || len(status.NextSlotWaits) != 0 {
+		t.Fatalf("expected one free slot, got %+v", status)
+	}
+
+	if code, _ := query(t, s, "q"); code != http.StatusOK {
+		t.Fatalf("expected the first query to succeed, got %d", code)
+	}
+	if code, _ := query(t, s, "q"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected a query during the cooldown to be rejected, got %d", code)
+	}
+	status, err = fetchStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.AvailableNow != 0 || len(status.NextSlotWaits) != 1 || status.NextSlotWaits[0] != time.Hour {
+		t.Fatalf("expected the slot to be cooling down for an hour, got %+v", status)
+	}
+	if stats := s.Stats(); stats != (Stats{Queries: 2, StatusFetches: 2, SlotRejections: 1, PeakRunning: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestServer_Respond(t *testing.T) {
+	s := NewServer(0, 0)
+	defer s.Close()
+	s.Respond("drinking_water", GatewayTimeout(), Fixture("remark_timeout"), Fixture("empty"))
+
+	var codes []int
+	for i := 0; i < 4; i++ {
+		code, body := query(t, s, `node[amenity=drinking_water];out;`)
+		codes = append(codes, code)
+		if i == 1 && !strings.Contains(body, "runtime error: Query timed out") {
+			t.Errorf("expected the timeout fixture, got %s", body)
+		}
+	}
+	if expected := []int{504, 200, 200, 200}; !slices.Equal(codes, expected) {
+		t.Errorf("expected status codes %v, got %v", expected, codes)
+	}
+	if _, body := query(t, s, `node[shop];out;`); !strings.Contains(body, `"Riverside Cafe"`) {
+		t.Errorf("expected an unmatched query to get the elements fixture, got %s", body)
+	}
+}
+
+func TestServer_SetStatus(t *testing.T) {
+	s := NewServer(2, 0)
+	defer s.Close()
+	s.SetStatus(StatusFixture("maintenance"))
+	resp, err := http.Get(s.StatusURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.Contains(string(body), "Down for maintenance") {
+		t.Fatalf("expected the maintenance page, got %s", body)
+	}
+}
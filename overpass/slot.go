@@ -0,0 +1,233 @@
+package overpass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slot is an API slot granted by Acquire. A caller holds it for one request,
+// made with Do or DoRequest, and must Release it once done with the response.
+// A Slot is not safe for concurrent use.
+type Slot struct {
+	c   *Client
+	ctx context.Context
+	// release gives the slot back to the client; nil for an unlimited server.
+	release func()
+	// rejected is set when the server answered 429, so the slot was never
+	// really used.
+	rejected bool
+	once     sync.Once
+}
+
+// Acquire blocks until the server has a slot free for a request, unless the
+// client is in unlimited mode, and with WithSharedSlots until one of the
+// shared slots is free too. ctx governs the wait and any request made with the
+// slot.
+func (c *Client) Acquire(ctx context.Context) (*Slot, error) {
+	if c.unlimited || c.shared == nil {
+		return c.acquire(ctx, time.Now())
+	}
+	requested := time.Now()
+	limit := c.rateLimit
+	if c.fixedSlots > 0 {
+		limit = c.fixedSlots
+	}
+	releaseShared, err := c.shared.Acquire(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for shared API slot: %w", err)
+	}
+	slot, err := c.acquire(ctx, requested)
+	if err != nil {
+		releaseShared(time.Now())
+		return nil, err
+	}
+	release := slot.release
+	slot.release = func() {
+		release()
+		if slot.rejected || c.fixedSlots > 0 {
+			// The server never took the slot, or frees it at once.
+			releaseShared(time.Now())
+			return
+		}
+		go func() { releaseShared(c.cooledDown()) }()
+	}
+	return slot, nil
+}
+
+// cooledDown returns when the server frees the slot of a query that has just
+// completed, by the cooldown estimate or, with none yet, by asking the
+// coordinator, which answers releases together from one fresh status.
+func (c *Client) cooledDown() time.Time {
+	if wait := c.cooldown.current(); wait > 0 {
+		return time.Now().Add(wait)
+	}
+	reply := make(chan time.Time, 1)
+	select {
+	case c.cooldowns <- reply:
+	case <-c.closeCtx.Done():
+		return time.Now()
+	}
+	select {
+	case freeAt := <-reply:
+		return freeAt
+	case <-c.closeCtx.Done():
+		return time.Now()
+	}
+}
+
+// acquire blocks until the client has a slot of its own free for a request
+// made at requested.
+func (c *Client) acquire(ctx context.Context, requested time.Time) (*Slot, error) {
+	slot := &Slot{c: c, ctx: ctx}
+	switch {
+	case c.fixedSlots > 0:
+		release, err := c.fixedSlot(ctx, requested)
+		if err != nil {
+			return nil, err
+		}
+		slot.release = release
+		return slot, nil
+	case c.unlimited:
+		return slot, nil
+	}
+
+	// Request a slot
+	req := &slotRequest{ctx: ctx, priority: ContextPriority(ctx), queued: requested, result: make(chan error, 1)}
+	select {
+	case c.requests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closeCtx.Done():
+		return nil, errors.New("client closed")
+	}
+
+	// Wait for slot
+	select {
+	case err := <-req.result:
+		if err != nil {
+			return nil, fmt.Errorf("waiting for API slot: %w", err)
+		}
+	case <-ctx.Done():
+		// Have the coordinator drop the request, or pass the slot on if it
+		// was granted meanwhile, so neither is lost.
+		go func() {
+			select {
+			case c.cancels <- req:
+			case <-c.closeCtx.Done():
+			}
+		}()
+		return nil, ctx.Err()
+	case <-c.closeCtx.Done():
+		return nil, errors.New("client closed")
+	}
+	c.slotGranted(ctx, time.Since(requested))
+	// The slot's cooldown starts once the server has finished with the
+	// request, so the coordinator hears of it on release.
+	slot.release = func() {
+		if !slot.rejected {
+			c.notify(c.completions)
+		}
+	}
+	return slot, nil
+}
+
+// Do sends query to the interpreter endpoint.
+func (s *Slot) Do(query string) (*http.Response, error) {
+	// The Overpass API expects POST bodies as form-encoded "data=<query>".
+	// Without explicit Content-Type, the server must guess the body format.
+	body := strings.NewReader(url.Values{"data": {query}}.Encode())
+	req, err := http.NewRequestWithContext(s.ctx, "POST", s.c.interpreterEndpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.DoRequest(req)
+}
+
+// DoRequest sends req, which may be for any of the server's endpoints, with
+// the headers the client sends with every request unless req sets them
+// itself. A 429 response is taken as the server having no slot after all, and
+// throttles the client's later requests.
+func (s *Slot) DoRequest(req *http.Request) (*http.Response, error) {
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for k, vs := range s.c.header {
+		if _, ok := req.Header[k]; !ok {
+			req.Header[k] = slices.Clone(vs)
+		}
+	}
+	resp, err := s.c.httpClient.Do(req)
+	if s.c.hooks.Response != nil {
+		if err != nil {
+			s.c.hooks.Response(0, err)
+		} else {
+			s.c.hooks.Response(resp.StatusCode, nil)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		s.rejected = true
+		s.c.rateLimited(resp)
+	case resp.StatusCode < 400 && s.c.bucket != nil:
+		s.c.bucket.succeeded()
+	}
+	return resp, nil
+}
+
+// Release gives the slot back to the client. It is safe to call more than
+// once.
+func (s *Slot) Release() {
+	s.once.Do(func() {
+		if s.release != nil {
+			s.release()
+		}
+	})
+}
+
+// rateLimited throttles the client after the server answered resp with 429.
+func (c *Client) rateLimited(resp *http.Response) {
+	switch {
+	case c.bucket != nil:
+		retryAfter := RetryAfter(resp.Header, time.Now())
+		c.logger.Warn("rate limited by server, pausing queries", "retry_after", retryAfter)
+		c.bucket.rateLimited(time.Now(), retryAfter)
+	case !c.unlimited:
+		// The server had no slot for us after all, so any tokens held are
+		// stale. Drop them so the next request waits on a fresh status.
+		c.logger.Debug("rate limited by server, discarding slot tokens")
+		c.drainTokens()
+		c.notify(c.rejections)
+	}
+}
+
+// ReleaseOnClose returns body, calling release when it is first closed, so
+// that what a response was sent with, such as its Slot, is held until the
+// caller is done reading it.
+func ReleaseOnClose(body io.ReadCloser, release func()) io.ReadCloser {
+	return &releasingBody{ReadCloser: body, release: release}
+}
+
+// releasingBody calls release when the response body is first closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -2,9 +2,12 @@ package overpass
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"sort"
@@ -15,9 +18,54 @@ import (
 
 // Status holds parsed status from the Overpass API status endpoint
 type Status struct {
-	RateLimit     int
-	AvailableNow  int
-	NextSlotWaits []time.Duration // sorted ascending
+	// AnnouncedEndpoint is the server the endpoint announces itself as, or
+	// empty if it announces none.
+	AnnouncedEndpoint string
+	RateLimit         int
+	AvailableNow      int
+	NextSlotWaits     []time.Duration // sorted ascending
+	// RunningQueries are the queries from this client's IP the server is
+	// running.
+	RunningQueries []RunningQuery
+	// Parsed records which parts of the status were present, so a missing
+	// line can be told apart from a zero value.
+	Parsed StatusFields
+}
+
+// Has reports whether all of fields were present in the status.
+func (s Status) Has(fields StatusFields) bool {
+	return s.Parsed&fields == fields
+}
+
+// StatusFields is a set of the parts of a status.
+type StatusFields uint8
+
+const (
+	StatusAnnouncedEndpoint StatusFields = 1 << iota // the "Announced endpoint" line
+	StatusRateLimit                                  // the "Rate limit" line
+	StatusAvailableNow                               // the "slots available now" line
+	StatusSlotWaits                                  // one or more "Slot available after" lines
+	StatusRunningQueries                             // the "Currently running queries" section, even if empty
+)
+
+// RunningQuery is a query listed as running in a status.
+type RunningQuery struct {
+	PID        int
+	SpaceLimit int64 // bytes
+	TimeLimit  time.Duration
+	Started    time.Time
+}
+
+// StatusFormatError reports a status body that isn't an Overpass status, such
+// as a maintenance page served in its place.
+type StatusFormatError struct {
+	Reason string
+	// Excerpt is the start of the offending body.
+	Excerpt string
+}
+
+func (e *StatusFormatError) Error() string {
+	return fmt.Sprintf("unrecognised status: %s: %q", e.Reason, e.Excerpt)
 }
 
 // StatusFetcher returns a function that fetches and parses the current status
@@ -25,72 +73,153 @@ type Status struct {
 // slow status fetch can be aborted (e.g. once work has completed elsewhere)
 // rather than blocking until the HTTP client's own timeout.
 func StatusFetcher(endpoint string) func(ctx context.Context) (Status, error) {
+	return parsingStatus(statusBodyFetcher(endpoint, http.Header{"User-Agent": {defaultUserAgent}}), slog.Default())
+}
+
+// defaultUserAgent identifies the application to Overpass servers. Overpass
+// API identifies users by IP; status and query endpoints are counted together
+// for rate-limiting, so both should identify the application.
+const defaultUserAgent = "route-poi-finder"
+
+// StatusBodyFetcher fetches the body of a server's status, unparsed.
+type StatusBodyFetcher func(ctx context.Context) ([]byte, error)
+
+// statusBodyFetcher fetches the status body from endpoint, sending header with
+// each request.
+func statusBodyFetcher(endpoint string, header http.Header) StatusBodyFetcher {
 	client := &http.Client{Timeout: 20 * time.Second}
-	return func(ctx context.Context) (Status, error) {
+	return func(ctx context.Context) ([]byte, error) {
 		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 		if err != nil {
-			return Status{}, fmt.Errorf("creating status request: %w", err)
+			return nil, fmt.Errorf("creating status request: %w", err)
 		}
-		// Overpass API identifies users by IP; status and query endpoints
-		// are counted together for rate-limiting, so both should identify
-		// the application.
-		req.Header.Set("User-Agent", "route-poi-finder")
+		req.Header = header.Clone()
 		resp, err := client.Do(req)
 		if err != nil {
-			return Status{}, fmt.Errorf("fetching status: %w", err)
+			return nil, fmt.Errorf("fetching status: %w", err)
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			return Status{}, fmt.Errorf("status endpoint returned %d", resp.StatusCode)
+			return nil, fmt.Errorf("status endpoint returned %d", resp.StatusCode)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading status: %w", err)
 		}
+		return body, nil
+	}
+}
 
-		return parseStatusResponse(resp.Body)
+// parsingStatus returns a function parsing the bodies fetch fetches, logging
+// the lines it skips to logger.
+func parsingStatus(fetch StatusBodyFetcher, logger *slog.Logger) func(ctx context.Context) (Status, error) {
+	return func(ctx context.Context) (Status, error) {
+		body, err := fetch(ctx)
+		if err != nil {
+			return Status{}, err
+		}
+		return parseStatusResponse(bytes.NewReader(body), logger)
 	}
 }
 
 // slotWaitRegex matches lines like "Slot available after: 2024-01-15T10:30:45Z, in 5 seconds."
-var slotWaitRegex = regexp.MustCompile(`Slot available after: .+, in (\d+) seconds\.`)
+var slotWaitRegex = regexp.MustCompile(`^Slot available after: .+, in (-?\d+) seconds\.$`)
+
+// runningQueriesHeader starts the section listing running queries, one per
+// line as "pid space-limit time-limit start-time".
+const runningQueriesHeader = "Currently running queries (pid, space limit, time limit, start time):"
 
-// parseStatusResponse parses the text response from /api/status endpoint
-func parseStatusResponse(r io.Reader) (Status, error) {
+// parseStatusResponse parses the text response from /api/status endpoint. A
+// body without a rate limit, which every status has, is rejected with a
+// *StatusFormatError rather than being taken as a status of zeroes. Any other
+// line that looks like part of a status but can't be parsed is skipped, and
+// logged to logger at debug, leaving its part of the status missing.
+func parseStatusResponse(r io.Reader, logger *slog.Logger) (Status, error) {
 	var status Status
 	scanner := bufio.NewScanner(r)
+	var first string
+	inRunning := false
 
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
+		if first == "" {
+			first = line
+		}
+		if line == "" {
+			continue
+		}
+		skip := func(reason string) {
+			logger.Debug("skipping unparseable status line", "reason", reason, "line", excerpt(line))
+		}
 
-		// Parse "Rate limit: N"
-		if strings.HasPrefix(line, "Rate limit:") {
-			parts := strings.TrimPrefix(line, "Rate limit:")
-			n, err := strconv.Atoi(strings.TrimSpace(parts))
-			if err == nil {
-				status.RateLimit = n
+		if inRunning {
+			q, err := parseRunningQuery(line)
+			if err != nil {
+				skip(err.Error())
+				continue
 			}
+			status.RunningQueries = append(status.RunningQueries, q)
 			continue
 		}
 
+		switch {
+		case line == runningQueriesHeader:
+			inRunning = true
+			status.Parsed |= StatusRunningQueries
+
+		case strings.HasPrefix(line, "Announced endpoint:"):
+			endpoint := strings.TrimSpace(strings.TrimPrefix(line, "Announced endpoint:"))
+			if endpoint != "none" {
+				status.AnnouncedEndpoint = endpoint
+			}
+			status.Parsed |= StatusAnnouncedEndpoint
+
+		// Parse "Rate limit: N"
+		case strings.HasPrefix(line, "Rate limit:"):
+			n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Rate limit:")))
+			if err != nil {
+				skip("invalid rate limit")
+				continue
+			}
+			status.RateLimit = n
+			status.Parsed |= StatusRateLimit
+
 		// Parse "N slots available now."
-		if strings.HasSuffix(line, "slots available now.") {
-			parts := strings.TrimSuffix(line, "slots available now.")
-			n, err := strconv.Atoi(strings.TrimSpace(parts))
-			if err == nil {
-				status.AvailableNow = n
+		case strings.HasSuffix(line, "slots available now."):
+			n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(line, "slots available now.")))
+			if err != nil {
+				skip("invalid available slots")
+				continue
 			}
-			continue
-		}
+			status.AvailableNow = n
+			status.Parsed |= StatusAvailableNow
 
 		// Parse "Slot available after: ..., in N seconds."
-		if matches := slotWaitRegex.FindStringSubmatch(line); len(matches) == 2 {
+		case strings.HasPrefix(line, "Slot available after:"):
+			matches := slotWaitRegex.FindStringSubmatch(line)
+			if matches == nil {
+				skip("invalid slot wait")
+				continue
+			}
 			seconds, err := strconv.Atoi(matches[1])
-			if err == nil {
-				status.NextSlotWaits = append(status.NextSlotWaits, time.Duration(seconds)*time.Second)
+			if err != nil {
+				skip("invalid slot wait")
+				continue
 			}
+			// A slot the server thinks freed while it wrote the status is
+			// free now.
+			status.NextSlotWaits = append(status.NextSlotWaits, max(time.Duration(seconds)*time.Second, 0))
+			status.Parsed |= StatusSlotWaits
 		}
 	}
 	if err := scanner.Err(); err != nil {
 		return Status{}, fmt.Errorf("scanning status response: %w", err)
 	}
+	if !status.Has(StatusRateLimit) {
+		return Status{}, &StatusFormatError{Reason: "no rate limit", Excerpt: excerpt(first)}
+	}
 
 	// Sort wait times ascending
 	sort.Slice(status.NextSlotWaits, func(i, j int) bool {
@@ -99,3 +228,37 @@ func parseStatusResponse(r io.Reader) (Status, error) {
 
 	return status, nil
 }
+
+// parseRunningQuery parses a line of the running queries section.
+func parseRunningQuery(line string) (RunningQuery, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return RunningQuery{}, errors.New("invalid running query")
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return RunningQuery{}, fmt.Errorf("invalid running query pid: %w", err)
+	}
+	space, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return RunningQuery{}, fmt.Errorf("invalid running query space limit: %w", err)
+	}
+	seconds, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return RunningQuery{}, fmt.Errorf("invalid running query time limit: %w", err)
+	}
+	started, err := time.Parse(time.RFC3339, fields[3])
+	if err != nil {
+		return RunningQuery{}, fmt.Errorf("invalid running query start time: %w", err)
+	}
+	return RunningQuery{PID: pid, SpaceLimit: space, TimeLimit: time.Duration(seconds) * time.Second, Started: started}, nil
+}
+
+// excerpt shortens s for an error message.
+func excerpt(s string) string {
+	const n = 80
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
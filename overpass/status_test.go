@@ -0,0 +1,130 @@
+package overpass
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass/overpasstest"
+)
+
+func TestParseStatusResponse(t *testing.T) {
+	status, err := parseStatusResponse(strings.NewReader(`Connected as: 2130706433
+Current time: 2024-01-15T10:30:40Z
+Announced endpoint: gall.openstreetmap.de/
+Rate limit: 2
+Slot available after: 2024-01-15T10:31:29Z, in 49 seconds.
+Slot available after: 2024-01-15T10:31:09Z, in 29 seconds.
+Currently running queries (pid, space limit, time limit, start time):
+12345	536870912	180	2024-01-15T10:30:38Z
+`), discardLogger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Status{
+		AnnouncedEndpoint: "gall.openstreetmap.de/",
+		RateLimit:         2,
+		NextSlotWaits:     []time.Duration{29 * time.Second, 49 * time.Second},
+		RunningQueries: []RunningQuery{{
+			PID:        12345,
+			SpaceLimit: 536870912,
+			TimeLimit:  180 * time.Second,
+			Started:    time.Date(2024, 1, 15, 10, 30, 38, 0, time.UTC),
+		}},
+		Parsed: StatusAnnouncedEndpoint | StatusRateLimit | StatusSlotWaits | StatusRunningQueries,
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, status)
+	}
+	if status.Has(StatusAvailableNow) {
+		t.Error("expected no available slots line to have been parsed")
+	}
+
+	unlimited, err := parseStatusResponse(strings.NewReader("Announced endpoint: none\nRate limit: 0\nCurrently running queries (pid, space limit, time limit, start time):\n"), discardLogger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !unlimited.Has(StatusRateLimit) || unlimited.RateLimit != 0 || unlimited.AnnouncedEndpoint != "" {
+		t.Errorf("expected a genuine unlimited status, got %+v", unlimited)
+	}
+}
+
+// discardLogger discards everything logged to it.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestParseStatusResponse_rejectsUnrecognisedBodies(t *testing.T) {
+	for name, body := range map[string]string{
+		"maintenance page": overpasstest.StatusFixture("maintenance"),
+		"empty":            "",
+		"bad rate limit":   "Rate limit: lots\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseStatusResponse(strings.NewReader(body), discardLogger)
+			var formatErr *StatusFormatError
+			if !errors.As(err, &formatErr) {
+				t.Fatalf("expected a *StatusFormatError, got %v", err)
+			}
+		})
+	}
+}
+
+// A status with a rate limit is taken whatever else it has, skipping the
+// lines that can't be parsed and logging each at debug.
+func TestParseStatusResponse_skipsUnparseableLines(t *testing.T) {
+	var logged bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logged, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	status, err := parseStatusResponse(strings.NewReader(`Rate limit: 2
+some slots available now.
+Slot available after: soon.
+Currently running queries (pid, space limit, time limit, start time):
+12345 lots
+12346	536870912	180	2024-01-15T10:30:38Z
+`), logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.RateLimit != 2 || status.Has(StatusAvailableNow) || status.Has(StatusSlotWaits) {
+		t.Errorf("expected only the rate limit and running queries, got %+v", status)
+	}
+	if len(status.RunningQueries) != 1 || status.RunningQueries[0].PID != 12346 {
+		t.Errorf("expected the one parseable running query, got %+v", status.RunningQueries)
+	}
+	if n := strings.Count(logged.String(), "skipping unparseable status line"); n != 3 {
+		t.Errorf("expected 3 skipped lines logged, got %d:\n%s", n, &logged)
+	}
+}
+
+// A server whose status is a maintenance page must fail to start rather than
+// be taken as unlimited.
+func TestClient_Start_rejectsMalformedStatus(t *testing.T) {
+	srv := overpasstest.NewServer(2, 0)
+	defer srv.Close()
+	srv.SetStatus(overpasstest.StatusFixture("maintenance"))
+
+	c := NewClient(srv.InterpreterURL(), srv.StatusURL(), time.Second)
+	defer c.Close()
+	err := c.Start(context.Background())
+	var formatErr *StatusFormatError
+	if !errors.As(err, &formatErr) {
+		t.Fatalf("expected a *StatusFormatError, got %v", err)
+	}
+	if c.Unlimited() {
+		t.Error("expected the client not to be unlimited")
+	}
+
+	srv.SetStatus("")
+	c = NewClient(srv.InterpreterURL(), srv.StatusURL(), time.Second)
+	defer c.Close()
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	if status := c.Status(); status.RateLimit != 2 || status.AvailableNow != 2 || !status.Has(StatusRunningQueries) {
+		t.Errorf("expected the status fetched at start, got %+v", status)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+
+	gpxgo "github.com/tkrajina/gpxgo/gpx"
+)
+
+// categoryStatsFile is the file in the cache dir recording how expensive each
+// category group was to query in previous runs.
+const categoryStatsFile = "category-stats.json"
+
+// categoryGroup names the group a query belongs to for planning: the tag of
+// its first condition, e.g. "amenity" or "waterway". Queries sharing a tag
+// tend to have similar densities, and this keeps the stats file readable.
+func categoryGroup(q query) string {
+	if len(q.conditions) == 0 {
+		return ""
+	}
+	return q.conditions[0].tag
+}
+
+// matches reports whether tags satisfy every condition of the query, mirroring
+// the filters renderConditionFilters renders.
+func (q query) matches(tags map[string]string) bool {
+	for _, c := range q.conditions {
+		if !c.matches(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c condition) matches(tags map[string]string) bool {
+	v, ok := tags[c.tag]
+	switch {
+	case len(c.values) > 0:
+		return ok && slices.Contains(c.values, v)
+	case len(c.notValues) > 0:
+		return !ok || !slices.Contains(c.notValues, v)
+	case c.exists == ExistsYes:
+		return ok
+	case c.exists == ExistsNo:
+		return !ok
+	}
+	return false
+}
+
+// elementWeight approximates how much an element costs the server to return:
+// one for the element plus one per geometry point, which is what makes long
+// waterways and boundaries expensive.
+func elementWeight(e element) float64 {
+	w := 1 + len(e.Geometry)
+	for _, m := range e.Members {
+		w += 1 + len(m.Geometry)
+	}
+	return float64(w)
+}
+
+// routeKm is the length of the route through pts in kilometres.
+func routeKm(pts []gpxgo.GPXPoint) float64 {
+	var m float64
+	for i := 1; i < len(pts); i++ {
+		m += gpxgo.Distance2D(pts[i-1].Latitude, pts[i-1].Longitude, pts[i].Latitude, pts[i].Longitude, true)
+	}
+	return m / 1000
+}
+
+// categoryCost is what querying one category group along a stretch of route
+// cost: the total weight of the elements it matched over the stretch's length.
+type categoryCost struct {
+	Weight float64 `json:"weight"`
+	Km     float64 `json:"km"`
+}
+
+// density is the cost per kilometre of route.
+func (c categoryCost) density() float64 {
+	if c.Km == 0 {
+		return 0
+	}
+	return c.Weight / c.Km
+}
+
+// unitCosts attributes the elements a unit's query returned to the unit's
+// category groups. An element matching several groups counts towards each.
+func unitCosts(unit workUnit, elements []element) map[string]categoryCost {
+	km := routeKm(unit.routePoints)
+	costs := make(map[string]categoryCost)
+	for _, q := range unit.queries {
+		costs[categoryGroup(q)] = categoryCost{Km: km}
+	}
+	for _, e := range elements {
+		weight := elementWeight(e)
+		matched := make(map[string]bool)
+		for _, q := range unit.queries {
+			group := categoryGroup(q)
+			if matched[group] || !q.matches(e.Tags) {
+				continue
+			}
+			matched[group] = true
+			c := costs[group]
+			c.Weight += weight
+			costs[group] = c
+		}
+	}
+	return costs
+}
+
+// categoryStats are the observed costs of each category group, keyed by
+// group. Each run halves the previous totals before adding its own, so recent
+// runs dominate the estimate.
+type categoryStats map[string]categoryCost
+
+func loadCategoryStats(cacheDir string) (categoryStats, error) {
+	b, err := os.ReadFile(filepath.Join(cacheDir, categoryStatsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return categoryStats{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading category stats: %w", err)
+	}
+	stats := categoryStats{}
+	if err := json.Unmarshal(b, &stats); err != nil {
+		return nil, fmt.Errorf("decoding category stats: %w", err)
+	}
+	return stats, nil
+}
+
+// record folds the costs observed by a run's results into the stats.
+func (s categoryStats) record(results []workResult) {
+	observed := make(map[string]categoryCost)
+	for _, r := range results {
+		for group, c := range r.costs {
+			o := observed[group]
+			o.Weight += c.Weight
+			o.Km += c.Km
+			observed[group] = o
+		}
+	}
+	for group, o := range observed {
+		prev := s[group]
+		s[group] = categoryCost{Weight: prev.Weight/2 + o.Weight, Km: prev.Km/2 + o.Km}
+	}
+}
+
+func (s categoryStats) save(cacheDir string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding category stats: %w", err)
+	}
+	if err := atomicSlurp(cacheDir, bytes.NewReader(b), filepath.Join(cacheDir, categoryStatsFile), nil); err != nil {
+		return fmt.Errorf("writing category stats: %w", err)
+	}
+	return nil
+}
+
+// planWorkUnits splits the route into work units like splitWorkUnits, except
+// that category groups whose estimated cost over a split would exceed budget
+// get units of their own, on route segments short enough to fit the budget.
+// The remaining groups share a union query per split as usual. Groups with no
+// stats yet are assumed to be cheap.
+func planWorkUnits(pts []gpxgo.GPXPoint, split uint, qs []query, stats categoryStats, budget float64) []workUnit {
+	km := routeKm(pts)
+	var shared []query
+	expensive := make(map[string][]query)
+	var expensiveOrder []string
+	for _, q := range qs {
+		group := categoryGroup(q)
+		if math.Ceil(stats[group].density()*km/budget) <= float64(split) {
+			shared = append(shared, q)
+			continue
+		}
+		if _, ok := expensive[group]; !ok {
+			expensiveOrder = append(expensiveOrder, group)
+		}
+		expensive[group] = append(expensive[group], q)
+	}
+
+	var units []workUnit
+	if len(shared) > 0 {
+		units = splitWorkUnits(pts, split, shared)
+	}
+	for _, group := range expensiveOrder {
+		groupQueries := expensive[group]
+		density := stats[group].density()
+		pieces := uint(math.Ceil(density * km / budget))
+		slog.Info("planning expensive category group on its own", "group", group, "km_per_split", km/float64(pieces), "splits", pieces, "estimated_cost", density*km)
+		units = append(units, splitWorkUnits(pts, pieces, groupQueries)...)
+	}
+	for i := range units {
+		units[i].splitIndex = i
+	}
+	return units
+}
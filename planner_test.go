@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	gpxgo "github.com/tkrajina/gpxgo/gpx"
+)
+
+func Test_query_matches(t *testing.T) {
+	waterway := query{conditions: []condition{
+		{tag: "waterway", exists: ExistsYes},
+		{tag: "waterway", notValues: []string{"drain", "ditch"}},
+	}}
+	for _, tc := range []struct {
+		tags     map[string]string
+		expected bool
+	}{
+		{tags: map[string]string{"waterway": "river"}, expected: true},
+		{tags: map[string]string{"waterway": "drain"}, expected: false},
+		{tags: map[string]string{"natural": "water"}, expected: false},
+		{tags: nil, expected: false},
+	} {
+		if actual := waterway.matches(tc.tags); actual != tc.expected {
+			t.Errorf("expected %v to match=%t, got %t", tc.tags, tc.expected, actual)
+		}
+	}
+}
+
+// straightRoute returns n points 0.01° of latitude (about 1.1km) apart.
+func straightRoute(n int) []gpxgo.GPXPoint {
+	pts := make([]gpxgo.GPXPoint, n)
+	for i := range pts {
+		pts[i].Latitude = float64(i) * 0.01
+	}
+	return pts
+}
+
+func Test_unitCosts(t *testing.T) {
+	amenities := query{conditions: []condition{{tag: "amenity", values: []string{"cafe"}}}}
+	waterways := query{conditions: []condition{{tag: "waterway", exists: ExistsYes}}}
+	unit := workUnit{queries: []query{amenities, waterways}, routePoints: straightRoute(2)}
+
+	costs := unitCosts(unit, []element{
+		{Type: "node", Tags: map[string]string{"amenity": "cafe"}},
+		{Type: "way", Tags: map[string]string{"waterway": "river"}, Geometry: make([]LatLon, 99)},
+	})
+	if c := costs["amenity"]; c.Weight != 1 {
+		t.Errorf("expected amenity weight 1, got %v", c.Weight)
+	}
+	if c := costs["waterway"]; c.Weight != 100 {
+		t.Errorf("expected waterway weight 100, got %v", c.Weight)
+	}
+	if km := costs["waterway"].Km; km < 1.1 || km > 1.12 {
+		t.Errorf("expected about 1.11km of route, got %v", km)
+	}
+}
+
+func Test_planWorkUnits(t *testing.T) {
+	amenities := query{conditions: []condition{{tag: "amenity", values: []string{"cafe"}}}}
+	shops := query{conditions: []condition{{tag: "shop", values: []string{"bakery"}}}}
+	waterways := query{conditions: []condition{{tag: "waterway", exists: ExistsYes}}}
+	pts := straightRoute(100) // about 110km
+
+	stats := categoryStats{
+		"amenity":  {Weight: 10, Km: 100},
+		"waterway": {Weight: 10000, Km: 100}, // 100 per km, about 11000 over the route
+	}
+	units := planWorkUnits(pts, 2, []query{amenities, waterways, shops}, stats, 1000)
+
+	var shared, waterwayUnits int
+	for i, u := range units {
+		if u.splitIndex != i {
+			t.Errorf("expected units to be numbered in order, unit %d has index %d", i, u.splitIndex)
+		}
+		switch categoryGroup(u.queries[0]) {
+		case "waterway":
+			waterwayUnits++
+			if len(u.queries) != 1 {
+				t.Errorf("expected waterway units to query only waterways, got %d queries", len(u.queries))
+			}
+		default:
+			shared++
+			if len(u.queries) != 2 {
+				t.Errorf("expected shared units to query amenities and shops, got %d queries", len(u.queries))
+			}
+		}
+	}
+	if shared != 2 {
+		t.Errorf("expected the cheap groups to keep the 2 requested splits, got %d", shared)
+	}
+	if waterwayUnits < 11 {
+		t.Errorf("expected waterways to be planned on at least 11 shorter splits, got %d", waterwayUnits)
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 var queries = []query{{
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	conditions: []condition{{
 		tag: "amenity",
 		values: []string{
@@ -20,7 +21,8 @@ var queries = []query{{
 		},
 	}},
 }, {
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	conditions: []condition{{
 		tag: "amenity",
 		values: []string{
@@ -38,7 +40,8 @@ var queries = []query{{
 		},
 	}},
 }, {
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	conditions: []condition{{
 		tag: "amenity",
 		values: []string{
@@ -48,7 +51,8 @@ var queries = []query{{
 		},
 	}},
 }, {
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	conditions: []condition{{
 		tag: "tourism",
 		values: []string{
@@ -63,13 +67,15 @@ var queries = []query{{
 		},
 	}},
 }, {
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	conditions: []condition{{
 		tag:    "accommodation",
 		exists: ExistsYes,
 	}},
 }, {
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	conditions: []condition{{
 		// Staffed info points that often have water taps, toilets and info,
 		// like ranger stations. Filter to visitor_centre/office to avoid the
@@ -81,6 +87,7 @@ var queries = []query{{
 		},
 	}},
 }, {
+	compact: true,
 	conditions: []condition{{
 		// - - tourism~"^(alpine_hut|camp_pitch|camp_site|guest_house|hostel|picnic_site|viewpoint|wilderness_hut)$"
 		tag: "tourism",
@@ -132,7 +139,8 @@ var queries = []query{{
 		},
 	}},
 }, {
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	conditions: []condition{{
 		// - - man_made~"^(spring_box|water_well|water_tap)$"
 		tag: "man_made",
@@ -144,7 +152,8 @@ var queries = []query{{
 		},
 	}},
 }, {
-	radius: 2000,
+	compact: true,
+	radius:  2000,
 	conditions: []condition{{
 		tag: "drinking_water",
 		values: []string{
@@ -172,6 +181,7 @@ var queries = []query{{
 		exists: ExistsYes,
 	}},
 }, {
+	compact: true,
 	conditions: []condition{{
 		// - - place~"^(town|village|hamlet|city|neighbourhood)$"
 		tag: "place",
@@ -184,7 +194,8 @@ var queries = []query{{
 		},
 	}},
 }, {
-	radius: 1000,
+	compact: true,
+	radius:  1000,
 	//- - amenity="fountain"
 	//  - drinking_water!="no"
 	//  - drinking_water~".+"
@@ -199,7 +210,8 @@ var queries = []query{{
 		notValues: []string{"no"},
 	}},
 }, {
-	radius: 2000,
+	compact: true,
+	radius:  2000,
 	conditions: []condition{{
 		tag: "shop",
 		values: []string{
@@ -225,8 +237,15 @@ var queries = []query{{
 		},
 	}},
 }, {
+	compact: true,
 	conditions: []condition{{
 		tag:    "mountain_pass",
 		values: []string{"yes"},
 	}}},
 }
+
+// profiles are the named query sets a `serve` job can pick between. The
+// default command always uses queries.
+var profiles = map[string][]query{
+	"default": queries,
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+)
+
+// trafficLogFile is the file in a --record directory listing every exchange
+// with the Overpass servers, one JSON object per line. Response and status
+// bodies are kept alongside it, one file each.
+const trafficLogFile = "traffic.jsonl"
+
+// Kinds of recorded exchange.
+const (
+	exchangeQuery  = "query"
+	exchangeStatus = "status"
+)
+
+// exchange is one recorded request to an Overpass server and its outcome.
+type exchange struct {
+	Seq        int         `json:"seq"`
+	Kind       string      `json:"kind"` // exchangeQuery or exchangeStatus
+	Endpoint   string      `json:"endpoint"`
+	Query      string      `json:"query,omitempty"`
+	Started    time.Time   `json:"started"`
+	Seconds    float64     `json:"seconds"` // until the body was read, including any slot wait
+	StatusCode int         `json:"status_code,omitempty"`
+	Status     string      `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Error      string      `json:"error,omitempty"` // set when there was no response
+	BodyFile   string      `json:"body_file,omitempty"`
+}
+
+// queryFunc sends a query to an Overpass server, like Client.Query.
+type queryFunc func(ctx context.Context, query string) (*http.Response, error)
+
+// trafficTap sees the traffic between a run and its Overpass servers, at the
+// seams where queries are sent (namedClient.query) and statuses are fetched
+// (overpass.WithStatusBody), so it can be recorded or replayed.
+type trafficTap interface {
+	// query answers query for endpoint, calling send to have the server
+	// answer it.
+	query(ctx context.Context, endpoint, query string, send queryFunc) (*http.Response, error)
+	// status wraps how endpoint's status body is fetched.
+	status(endpoint string) func(fetch overpass.StatusBodyFetcher) overpass.StatusBodyFetcher
+}
+
+// trafficRecorder records every query, response and status body, with their
+// timing, to a directory, for a trafficReplay to serve back. Queries answered
+// from the cache never reach a server, so aren't recorded.
+type trafficRecorder struct {
+	dir string
+
+	mu  sync.Mutex
+	log *os.File
+	enc *json.Encoder
+	seq int
+}
+
+func newTrafficRecorder(dir string) (*trafficRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating record dir: %w", err)
+	}
+	f, err := os.Create(filepath.Join(dir, trafficLogFile))
+	if err != nil {
+		return nil, fmt.Errorf("creating traffic log: %w", err)
+	}
+	return &trafficRecorder{dir: dir, log: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *trafficRecorder) query(ctx context.Context, endpoint, query string, send queryFunc) (*http.Response, error) {
+	ex := exchange{Kind: exchangeQuery, Endpoint: endpoint, Query: query, Started: time.Now()}
+	resp, err := send(ctx, query)
+	if err != nil {
+		ex.Seconds = time.Since(ex.Started).Seconds()
+		ex.Error = err.Error()
+		if saveErr := r.save(ex, nil); saveErr != nil {
+			return nil, saveErr
+		}
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	ex.Seconds = time.Since(ex.Started).Seconds()
+	ex.StatusCode, ex.Status, ex.Header = resp.StatusCode, resp.Status, resp.Header
+	if err := r.save(ex, body); err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (r *trafficRecorder) status(endpoint string) func(overpass.StatusBodyFetcher) overpass.StatusBodyFetcher {
+	return func(fetch overpass.StatusBodyFetcher) overpass.StatusBodyFetcher {
+		return func(ctx context.Context) ([]byte, error) {
+			ex := exchange{Kind: exchangeStatus, Endpoint: endpoint, Started: time.Now()}
+			body, err := fetch(ctx)
+			ex.Seconds = time.Since(ex.Started).Seconds()
+			if err != nil {
+				ex.Error = err.Error()
+			}
+			if saveErr := r.save(ex, body); saveErr != nil {
+				return nil, saveErr
+			}
+			return body, err
+		}
+	}
+}
+
+// save appends ex to the traffic log, writing body to its own file.
+func (r *trafficRecorder) save(ex exchange, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	ex.Seq = r.seq
+	if body != nil {
+		ex.BodyFile = fmt.Sprintf("%06d-%s.body", ex.Seq, ex.Kind)
+		if err := os.WriteFile(filepath.Join(r.dir, ex.BodyFile), body, 0o644); err != nil {
+			return fmt.Errorf("recording %s body: %w", ex.Kind, err)
+		}
+	}
+	if err := r.enc.Encode(ex); err != nil {
+		return fmt.Errorf("recording %s: %w", ex.Kind, err)
+	}
+	return nil
+}
+
+func (r *trafficRecorder) close() error {
+	if err := r.log.Close(); err != nil {
+		return fmt.Errorf("closing traffic log: %w", err)
+	}
+	return nil
+}
+
+// trafficReplay serves the traffic recorded by a trafficRecorder back without
+// any network access. A query is answered with the responses recorded for the
+// same query, in the order they were recorded, whichever endpoint it is sent
+// to; a status with the bodies recorded for the endpoint, in order. Once
+// they're used up, the last is repeated. Recorded timings aren't replayed, so
+// a replay runs as fast as it can.
+type trafficReplay struct {
+	dir string
+
+	mu       sync.Mutex
+	queries  map[string][]exchange // by query
+	statuses map[string][]exchange // by endpoint
+}
+
+func loadTrafficReplay(dir string) (*trafficReplay, error) {
+	f, err := os.Open(filepath.Join(dir, trafficLogFile))
+	if err != nil {
+		return nil, fmt.Errorf("opening traffic log: %w", err)
+	}
+	defer f.Close()
+	r := &trafficReplay{dir: dir, queries: map[string][]exchange{}, statuses: map[string][]exchange{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20) // a line holds a whole query
+	for scanner.Scan() {
+		var ex exchange
+		if err := json.Unmarshal(scanner.Bytes(), &ex); err != nil {
+			return nil, fmt.Errorf("decoding traffic log: %w", err)
+		}
+		switch ex.Kind {
+		case exchangeQuery:
+			r.queries[ex.Query] = append(r.queries[ex.Query], ex)
+		case exchangeStatus:
+			r.statuses[ex.Endpoint] = append(r.statuses[ex.Endpoint], ex)
+		default:
+			return nil, fmt.Errorf("traffic log entry %d: unknown kind %q", ex.Seq, ex.Kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading traffic log: %w", err)
+	}
+	return r, nil
+}
+
+// next returns the next exchange recorded under key.
+func (r *trafficReplay) next(recorded map[string][]exchange, key string) (exchange, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exs := recorded[key]
+	if len(exs) == 0 {
+		return exchange{}, false
+	}
+	if len(exs) > 1 {
+		recorded[key] = exs[1:]
+	}
+	return exs[0], true
+}
+
+func (r *trafficReplay) body(ex exchange) ([]byte, error) {
+	if ex.BodyFile == "" {
+		return nil, nil
+	}
+	body, err := os.ReadFile(filepath.Join(r.dir, ex.BodyFile))
+	if err != nil {
+		return nil, fmt.Errorf("replaying %s %d: %w", ex.Kind, ex.Seq, err)
+	}
+	return body, nil
+}
+
+func (r *trafficReplay) query(_ context.Context, _, query string, _ queryFunc) (*http.Response, error) {
+	ex, ok := r.next(r.queries, query)
+	if !ok {
+		return nil, fmt.Errorf("replaying: no response recorded for query %q", query[:min(80, len(query))])
+	}
+	if ex.Error != "" {
+		return nil, replayedError(ex.Error)
+	}
+	body, err := r.body(ex)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: ex.StatusCode,
+		Status:     ex.Status,
+		Header:     ex.Header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func (r *trafficReplay) status(endpoint string) func(overpass.StatusBodyFetcher) overpass.StatusBodyFetcher {
+	return func(overpass.StatusBodyFetcher) overpass.StatusBodyFetcher {
+		return func(context.Context) ([]byte, error) {
+			ex, ok := r.next(r.statuses, endpoint)
+			if !ok {
+				return nil, fmt.Errorf("replaying: no status recorded for endpoint %s", endpoint)
+			}
+			if ex.Error != "" {
+				return nil, errors.New(ex.Error)
+			}
+			return r.body(ex)
+		}
+	}
+}
+
+// replayedError is a recorded error from sending a query. Only a network
+// error stops a query getting a response, so it replays as one, to be retried
+// as the original was.
+type replayedError string
+
+func (e replayedError) Error() string   { return string(e) }
+func (e replayedError) Timeout() bool   { return false }
+func (e replayedError) Temporary() bool { return false }
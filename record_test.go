@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+	"github.com/glynternet/route-poi-finder/overpass/overpasstest"
+)
+
+// A run recorded against a server replays the same way once the server is
+// gone: the status lets the client start, and a query that needed a retry
+// needs one again.
+func Test_trafficRecorder_replay(t *testing.T) {
+	dir := t.TempDir()
+	srv := overpasstest.NewServer(2, 0)
+	srv.Respond("", overpasstest.GatewayTimeout(), overpasstest.Fixture("elements"))
+
+	run := func(traffic trafficTap) (queryOutcome, retryState) {
+		t.Helper()
+		client := overpass.NewClient(srv.InterpreterURL(), srv.StatusURL(), 5*time.Second,
+			overpass.WithStatusBody(traffic.status("fake")))
+		defer client.Close()
+		if err := client.Start(context.Background()); err != nil {
+			t.Fatalf("starting client: %v", err)
+		}
+		c := namedClient{name: "fake", client: client, traffic: traffic}
+		cache := cacheConfig{dir: t.TempDir(), ttl: time.Hour}
+		var state retryState
+		outcome, err := retrier[queryOutcome](retryPolicy{maxRetries: 2})(context.Background(), &state, func() (queryOutcome, error) {
+			return queryResponseElementsRaw(context.Background(), cache, c.query, "[out:json];node;out;")
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return outcome, state
+	}
+
+	recorder, err := newTrafficRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, recordedState := run(recorder)
+	if err := recorder.close(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	replay, err := loadTrafficReplay(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, replayedState := run(replay)
+	if len(replayed.elements) != len(recorded.elements) || len(replayed.elements) != 2 {
+		t.Errorf("expected the 2 recorded elements to be replayed, got %d", len(replayed.elements))
+	}
+	if replayedState.attempts != recordedState.attempts || replayedState.attempts != 2 {
+		t.Errorf("expected the replay to retry as the recording did, got %d attempts for %d", replayedState.attempts, recordedState.attempts)
+	}
+
+	if _, err := replay.query(context.Background(), "fake", "[out:json];way;out;", nil); err == nil {
+		t.Error("expected an error replaying a query that was never recorded")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of runtime error Overpass reports in a response's remark.
+const (
+	remarkTimeout     = "timeout"
+	remarkOutOfMemory = "out of memory"
+	remarkOther       = "other"
+)
+
+// remarkError is a runtime error Overpass reported in the remark of an
+// otherwise successful (HTTP 200) response. The elements accompanying it are
+// whatever the query produced before it failed, so must not be trusted or
+// cached.
+type remarkError struct {
+	remark string
+	kind   string // remarkTimeout, remarkOutOfMemory or remarkOther
+}
+
+func (e *remarkError) Error() string {
+	return fmt.Sprintf("overpass reported an incomplete result: %s", e.remark)
+}
+
+// resourceExhausted reports whether the query ran out of time or memory on the
+// server, which retrying (on a less loaded server) or querying a smaller area
+// may avoid.
+func (e *remarkError) resourceExhausted() bool {
+	return e.kind == remarkTimeout || e.kind == remarkOutOfMemory
+}
+
+// parseRemark classifies a response's remark, returning nil unless it reports a
+// runtime error. Informational remarks ("runtime remark: ...") are not errors.
+func parseRemark(remark string) *remarkError {
+	if !strings.Contains(remark, "runtime error") {
+		return nil
+	}
+	kind := remarkOther
+	lower := strings.ToLower(remark)
+	switch {
+	case strings.Contains(lower, "timed out"):
+		kind = remarkTimeout
+	case strings.Contains(lower, "out of memory"):
+		kind = remarkOutOfMemory
+	}
+	return &remarkError{remark: strings.TrimSpace(remark), kind: kind}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseRemark(t *testing.T) {
+	for _, tc := range []struct {
+		remark    string
+		kind      string // "" for no error
+		retryable bool
+	}{
+		{remark: ""},
+		{remark: "runtime remark: Timeout is 180 and maxsize is 536870912."},
+		{remark: `runtime error: Query timed out in "query" at line 1 after 181 seconds.`, kind: remarkTimeout, retryable: true},
+		{remark: "runtime error: Query run out of memory using about 2048 MB of RAM.", kind: remarkOutOfMemory, retryable: true},
+		{remark: "runtime error: open64: 2 No such file or directory /osm3s_osm_base Dispatcher_Client::1", kind: remarkOther},
+	} {
+		t.Run(tc.remark, func(t *testing.T) {
+			err := parseRemark(tc.remark)
+			if tc.kind == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.kind != tc.kind {
+				t.Fatalf("expected %s error, got %v", tc.kind, err)
+			}
+			if retryable := isRetryableError(err); retryable != tc.retryable {
+				t.Errorf("expected retryable=%t, got %t", tc.retryable, retryable)
+			}
+		})
+	}
+}
+
+func Test_queryResponseElementsRaw_doesNotCacheRemarkErrors(t *testing.T) {
+	cache := cacheConfig{dir: t.TempDir(), ttl: time.Hour}
+	body := `{"elements":[{"type":"node","id":1}],"remark":"runtime error: Query timed out in \"query\" at line 1 after 181 seconds."}`
+	calls := 0
+	makeQueryRequest := func(context.Context, string) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := queryResponseElementsRaw(context.Background(), cache, makeQueryRequest, "[out:json];node;out;")
+		var remarkErr *remarkError
+		if !errors.As(err, &remarkErr) || remarkErr.kind != remarkTimeout {
+			t.Fatalf("expected a timeout remark error, got %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected the incomplete response to be re-queried rather than cached, got %d calls", calls)
+	}
+	entries, err := os.ReadDir(cache.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected an empty cache, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// runReport summarises a run for --report: what each split queried and how,
+// and how each endpoint's provisioning went.
+type runReport struct {
+	Started         time.Time        `json:"started"`
+	Finished        time.Time        `json:"finished"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	POIs            int              `json:"pois"`
+	Splits          []splitReport    `json:"splits"`
+	Endpoints       []endpointReport `json:"endpoints"`
+}
+
+// splitReport is one split's outcome. Split is 1-based, matching the log.
+type splitReport struct {
+	Split          int     `json:"split"`
+	State          string  `json:"state"` // splitQueued, splitRunning, splitDone, splitFailed or splitResplit
+	Endpoint       string  `json:"endpoint,omitempty"`
+	Cache          string  `json:"cache,omitempty"`
+	Retries        int     `json:"retries"`
+	QueryBytes     int     `json:"query_bytes"`
+	Elements       int     `json:"elements"`
+	Nodes          int     `json:"nodes"`
+	WayPoints      int     `json:"way_points"`
+	WaitSeconds    float64 `json:"wait_seconds"`
+	ExecuteSeconds float64 `json:"execute_seconds"`
+	Error          string  `json:"error,omitempty"`
+	Children       []int   `json:"children,omitempty"`
+}
+
+// endpointReport is one endpoint's provisioning outcome and the splits it
+// served.
+type endpointReport struct {
+	Name      string `json:"name"`
+	Outcome   string `json:"outcome"` // endpointReady, endpointFailed, endpointCancelled or endpointUnneeded
+	RateLimit int    `json:"rate_limit"`
+	Unlimited bool   `json:"unlimited"`
+	Capacity  int    `json:"capacity"`
+	Splits    int    `json:"splits"`
+	Error     string `json:"error,omitempty"`
+}
+
+// reportBuilder assembles a runReport from the run's events.
+type reportBuilder struct {
+	mu        sync.Mutex
+	started   time.Time
+	pois      int
+	splits    map[int]*splitReport
+	endpoints map[string]*endpointReport
+}
+
+func newReportBuilder() *reportBuilder {
+	return &reportBuilder{
+		started:   time.Now(),
+		splits:    make(map[int]*splitReport),
+		endpoints: make(map[string]*endpointReport),
+	}
+}
+
+func (b *reportBuilder) sink() eventSink {
+	return func(e runEvent) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		switch e.Type {
+		case eventSplitQueued:
+			b.splits[e.Split] = &splitReport{Split: e.Split, State: splitQueued}
+		case eventSplitStarted:
+			s := b.split(e.Split)
+			s.State, s.Endpoint = splitRunning, e.Endpoint
+		case eventSplitRetried:
+			b.split(e.Split).Retries = e.Attempt
+		case eventSplitCompleted:
+			s := b.split(e.Split)
+			s.State = splitDone
+			s.Endpoint = e.Endpoint
+			s.Cache = e.Cache
+			s.QueryBytes = e.QueryBytes
+			s.Elements = e.Elements
+			s.Nodes = e.Nodes
+			s.WayPoints = e.WayPoints
+			s.WaitSeconds = e.WaitSeconds
+			s.ExecuteSeconds = e.ExecuteSeconds
+		case eventSplitFailed:
+			s := b.split(e.Split)
+			s.State, s.Endpoint, s.Error = splitFailed, e.Endpoint, e.Error
+		case eventSplitResplit:
+			s := b.split(e.Split)
+			s.State, s.Endpoint, s.Error, s.Children = splitResplit, e.Endpoint, e.Error, e.Children
+		case eventSplitFailover:
+			s := b.split(e.Split)
+			s.State, s.Error = splitQueued, e.Error
+		case eventEndpoint:
+			b.endpoints[e.Endpoint] = &endpointReport{
+				Name:      e.Endpoint,
+				Outcome:   e.Outcome,
+				RateLimit: e.RateLimit,
+				Unlimited: e.Unlimited,
+				Capacity:  e.Capacity,
+				Error:     e.Error,
+			}
+		case eventPOIs:
+			b.pois = e.POIs
+		}
+	}
+}
+
+func (b *reportBuilder) split(n int) *splitReport {
+	s, ok := b.splits[n]
+	if !ok {
+		s = &splitReport{Split: n}
+		b.splits[n] = s
+	}
+	return s
+}
+
+// report returns the report of the events seen so far.
+func (b *reportBuilder) report() runReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	finished := time.Now()
+	r := runReport{
+		Started:         b.started,
+		Finished:        finished,
+		DurationSeconds: finished.Sub(b.started).Seconds(),
+		POIs:            b.pois,
+		Splits:          []splitReport{},
+		Endpoints:       []endpointReport{},
+	}
+	served := make(occurrences[string])
+	for _, s := range b.splits {
+		r.Splits = append(r.Splits, *s)
+		if s.State == splitDone {
+			served.mark(s.Endpoint)
+		}
+	}
+	for _, ep := range b.endpoints {
+		epr := *ep
+		epr.Splits = served[ep.Name]
+		r.Endpoints = append(r.Endpoints, epr)
+	}
+	slices.SortFunc(r.Splits, func(a, b splitReport) int {
+		return cmp.Compare(a.Split, b.Split)
+	})
+	slices.SortFunc(r.Endpoints, func(a, b endpointReport) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return r
+}
+
+// writeReportFile writes r as indented JSON to path.
+func writeReportFile(path string, r runReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating report file: %w", err)
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing report: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing report file: %w", err)
+	}
+	return nil
+}
+
+// writeReportTable writes r to w as human-readable tables.
+func writeReportTable(w io.Writer, r runReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "ENDPOINT\tOUTCOME\tRATE LIMIT\tCAPACITY\tSPLITS\tERROR\n")
+	for _, ep := range r.Endpoints {
+		rateLimit := fmt.Sprint(ep.RateLimit)
+		if ep.Unlimited {
+			rateLimit = "unlimited"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", ep.Name, ep.Outcome, rateLimit, ep.Capacity, ep.Splits, ep.Error)
+	}
+	_, _ = fmt.Fprintf(tw, "\n")
+	_, _ = fmt.Fprintf(tw, "SPLIT\tSTATE\tENDPOINT\tCACHE\tRETRIES\tQUERY B\tELEMENTS\tNODES\tWAY PTS\tWAIT\tEXECUTE\tERROR\n")
+	for _, s := range r.Splits {
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			s.Split, s.State, s.Endpoint, s.Cache, s.Retries, s.QueryBytes, s.Elements, s.Nodes, s.WayPoints,
+			seconds(s.WaitSeconds), seconds(s.ExecuteSeconds), s.Error)
+	}
+	_, _ = fmt.Fprintf(tw, "\n%d POIs in %s\n", r.POIs, seconds(r.DurationSeconds))
+	return tw.Flush()
+}
+
+func seconds(s float64) string {
+	return (time.Duration(s * float64(time.Second))).Round(10 * time.Millisecond).String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_reportBuilder(t *testing.T) {
+	b := newReportBuilder()
+	sink := eventSink(b.sink())
+	for _, e := range []runEvent{
+		{Type: eventSplitQueued, Split: 1},
+		{Type: eventSplitQueued, Split: 2},
+		{Type: eventEndpoint, Endpoint: "slow", Outcome: endpointFailed, Error: "initial status fetch: timeout"},
+		{Type: eventEndpoint, Endpoint: "main", Outcome: endpointReady, RateLimit: 2, Capacity: 2},
+		{Type: eventSplitStarted, Split: 2, Endpoint: "main"},
+		{Type: eventSplitRetried, Split: 2, Endpoint: "main", Attempt: 1},
+		{Type: eventSplitRetried, Split: 2, Endpoint: "main", Attempt: 2},
+		{Type: eventSplitCompleted, Split: 2, Endpoint: "main", Cache: cacheMiss, QueryBytes: 900, Elements: 4, Nodes: 3, WayPoints: 1, WaitSeconds: 1.5, ExecuteSeconds: 2},
+		{Type: eventSplitStarted, Split: 1, Endpoint: "main"},
+		{Type: eventSplitFailed, Split: 1, Endpoint: "main", Error: "boom"},
+		{Type: eventPOIs, POIs: 4},
+	} {
+		sink.emit(e)
+	}
+
+	r := b.report()
+	if r.POIs != 4 {
+		t.Errorf("expected 4 POIs, got %d", r.POIs)
+	}
+	if len(r.Splits) != 2 {
+		t.Fatalf("expected 2 splits, got %+v", r.Splits)
+	}
+	if s := r.Splits[0]; s.Split != 1 || s.State != splitFailed || s.Error != "boom" {
+		t.Errorf("unexpected split 1: %+v", s)
+	}
+	expected := splitReport{Split: 2, State: splitDone, Endpoint: "main", Cache: cacheMiss, Retries: 2, QueryBytes: 900, Elements: 4, Nodes: 3, WayPoints: 1, WaitSeconds: 1.5, ExecuteSeconds: 2}
+	if s := r.Splits[1]; !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected split 2 to be %+v, got %+v", expected, s)
+	}
+	if len(r.Endpoints) != 2 {
+		t.Fatalf("expected 2 endpoints, got %+v", r.Endpoints)
+	}
+	if ep := r.Endpoints[0]; ep.Name != "main" || ep.Outcome != endpointReady || ep.RateLimit != 2 || ep.Splits != 1 {
+		t.Errorf("unexpected main endpoint: %+v", ep)
+	}
+	if ep := r.Endpoints[1]; ep.Name != "slow" || ep.Outcome != endpointFailed || ep.Splits != 0 {
+		t.Errorf("unexpected slow endpoint: %+v", ep)
+	}
+
+	var sb strings.Builder
+	if err := writeReportTable(&sb, r); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), "4 POIs") {
+		t.Errorf("table missing POI count:\n%s", sb.String())
+	}
+}
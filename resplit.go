@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// resplitError reports that a unit's query exhausted the server's resources
+// and should be split into smaller pieces rather than retried as is. It does
+// not unwrap to the underlying remarkError, so retriers give up on it at once.
+type resplitError struct {
+	cause *remarkError
+}
+
+func (e *resplitError) Error() string {
+	return fmt.Sprintf("query too expensive, resplitting: %v", e.cause)
+}
+
+// resplitter bisects work units whose queries exhaust a server's time or
+// memory, so one dense stretch of route can be queried in smaller pieces
+// without over-splitting the rest. A nil *resplitter never bisects.
+type resplitter struct {
+	minPoints int
+	next      atomic.Int64 // index to give the next new split
+}
+
+// newResplitter returns a resplitter whose halves have at least minPoints
+// route points each, numbering new splits after the run's existing splits.
+func newResplitter(minPoints, splits int) *resplitter {
+	r := &resplitter{minPoints: minPoints}
+	r.next.Store(int64(splits))
+	return r
+}
+
+// bisect returns unit's route split in two at its midpoint, or nil if either
+// half would have fewer than minPoints points. Both halves include the
+// midpoint so the leg either side of it is still covered. The halves are
+// unnumbered until passed to number.
+func (r *resplitter) bisect(unit workUnit) []workUnit {
+	if r == nil {
+		return nil
+	}
+	mid := len(unit.routePoints) / 2
+	first, second := unit.routePoints[:mid+1], unit.routePoints[mid:]
+	if len(first) < r.minPoints || len(second) < r.minPoints || len(first) == len(unit.routePoints) {
+		return nil
+	}
+	return []workUnit{
+		{queries: unit.queries, routePoints: first},
+		{queries: unit.queries, routePoints: second},
+	}
+}
+
+// number gives each unit the next free split index.
+func (r *resplitter) number(units []workUnit) []workUnit {
+	for i := range units {
+		units[i].splitIndex = int(r.next.Add(1) - 1)
+	}
+	return units
+}
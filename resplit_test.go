@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	gpxgo "github.com/tkrajina/gpxgo/gpx"
+)
+
+func Test_resplitter_bisect(t *testing.T) {
+	route := func(n int) []gpxgo.GPXPoint {
+		pts := make([]gpxgo.GPXPoint, n)
+		for i := range pts {
+			pts[i].Latitude = float64(i)
+		}
+		return pts
+	}
+
+	r := newResplitter(3, 5)
+	halves := r.bisect(workUnit{splitIndex: 2, routePoints: route(6)})
+	if len(halves) != 2 {
+		t.Fatalf("expected 2 halves, got %d", len(halves))
+	}
+	first, second := halves[0].routePoints, halves[1].routePoints
+	if len(first) != 4 || len(second) != 3 {
+		t.Fatalf("expected halves of 4 and 3 points, got %d and %d", len(first), len(second))
+	}
+	if first[len(first)-1].Latitude != second[0].Latitude {
+		t.Errorf("expected the halves to share the midpoint")
+	}
+
+	halves = r.number(halves)
+	if halves[0].splitIndex != 5 || halves[1].splitIndex != 6 {
+		t.Errorf("expected halves to be numbered after the existing splits, got %d and %d", halves[0].splitIndex, halves[1].splitIndex)
+	}
+
+	if halves := r.bisect(workUnit{routePoints: route(4)}); halves != nil {
+		t.Errorf("expected a 4 point route not to be bisected below 3 points, got %d halves", len(halves))
+	}
+	if halves := (*resplitter)(nil).bisect(workUnit{routePoints: route(100)}); halves != nil {
+		t.Errorf("expected a nil resplitter never to bisect")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+)
+
+// retryPolicy decides whether, when and where a failed API request is retried.
+type retryPolicy struct {
+	maxRetries int
+	// baseDelay and maxDelay bound the exponential backoff between attempts,
+	// from which each delay is drawn with full jitter.
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	// maxElapsed caps the time from a unit's first attempt after which no
+	// further retry is started; 0 for no cap.
+	maxElapsed time.Duration
+	// failover hands a unit that hit a server or network error back to the
+	// pool with a *failoverError, so it can be retried on another endpoint,
+	// rather than backing off and retrying it on the same one.
+	failover bool
+}
+
+// newRetryPolicy returns the retry policy used for API requests, allowing up
+// to maxRetries retries.
+func newRetryPolicy(maxRetries int) retryPolicy {
+	return retryPolicy{
+		maxRetries: maxRetries,
+		baseDelay:  5 * time.Second,
+		maxDelay:   60 * time.Second,
+	}
+}
+
+// delay returns how long to wait before retrying after err, the attempt'th
+// failed attempt. A server's Retry-After is honoured as is. A throttled 429
+// is retried at once: the request goes back to its client, which waits for
+// the server to report a free slot or for its token bucket. Anything else,
+// including a 429 from a server the client sends to without limit, backs off
+// exponentially with full jitter, so units failing together don't retry in
+// lockstep.
+func (p retryPolicy) delay(err error, attempt int) time.Duration {
+	var httpErr *httpStatusError
+	if errors.As(err, &httpErr) {
+		if httpErr.retryAfter > 0 {
+			return httpErr.retryAfter
+		}
+		if httpErr.statusCode == http.StatusTooManyRequests && httpErr.throttled {
+			return 0
+		}
+	}
+	ceiling := p.maxDelay
+	if shift := attempt - 1; shift < 32 && p.baseDelay<<shift < ceiling {
+		ceiling = p.baseDelay << shift
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// failsOver reports whether err is worth trying on another endpoint: the
+// server is failing or unreachable, rather than busy or given an expensive
+// query.
+func failsOver(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var httpErr *httpStatusError
+	return errors.As(err, &httpErr) && httpErr.statusCode >= 500
+}
+
+// retryState is a unit's progress through its retry policy. It travels with
+// the unit when the unit fails over, so retries and elapsed time are capped
+// across every endpoint the unit is tried on.
+type retryState struct {
+	attempts int       // attempts made so far
+	started  time.Time // start of the first attempt
+	lastErr  error     // error of the latest attempt
+}
+
+// failoverError reports that a unit should be retried on another endpoint.
+type failoverError struct {
+	state retryState
+}
+
+func (e *failoverError) Error() string {
+	return fmt.Sprintf("failing over after attempt %d: %v", e.state.attempts, e.state.lastErr)
+}
+
+func (e *failoverError) Unwrap() error { return e.state.lastErr }
+
+// httpStatusError wraps HTTP status code errors for retry logic
+type httpStatusError struct {
+	statusCode int
+	status     string
+	// retryAfter is the delay the server asked for in a Retry-After header,
+	// or 0 if it didn't.
+	retryAfter time.Duration
+	// throttled is set for a 429 from a server whose client holds back the
+	// next request itself, waiting for a fresh status or for its token
+	// bucket.
+	throttled bool
+}
+
+// newHTTPStatusError returns the error for resp's unexpected status.
+func newHTTPStatusError(resp *http.Response) *httpStatusError {
+	return &httpStatusError{
+		statusCode: resp.StatusCode,
+		status:     resp.Status,
+		retryAfter: overpass.RetryAfter(resp.Header, time.Now()),
+	}
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d (%s)", e.statusCode, e.status)
+}
+
+// isRetryableError determines if an error should trigger a retry
+func isRetryableError(err error) bool {
+	// Network errors are retryable
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// Check for HTTP status code errors
+	var httpErr *httpStatusError
+	if errors.As(err, &httpErr) {
+		return httpErr.statusCode >= 500 || httpErr.statusCode == http.StatusTooManyRequests
+	}
+
+	// Runtime errors reported in a 200 response's remark
+	var remarkErr *remarkError
+	if errors.As(err, &remarkErr) {
+		return remarkErr.resourceExhausted()
+	}
+
+	return false
+}
+
+// retrier returns a function that runs queryFn until it succeeds or p gives
+// up, recording progress in state. With p.failover, a failure worth trying
+// elsewhere returns a *failoverError carrying state instead of being retried.
+func retrier[T any](p retryPolicy) func(ctx context.Context, state *retryState, queryFn func() (T, error)) (T, error) {
+	return func(ctx context.Context, state *retryState, queryFn func() (T, error)) (T, error) {
+		if state.started.IsZero() {
+			state.started = time.Now()
+		}
+		for {
+			if state.attempts > 0 {
+				slog.Info("retrying after error", "attempt", state.attempts, "max", p.maxRetries, "err", state.lastErr)
+				metricRetryAttempts.inc()
+			}
+
+			result, err := queryFn()
+			state.attempts++
+			state.lastErr = err
+			if err == nil {
+				return result, nil
+			}
+
+			// Only retry on transient errors
+			if !isRetryableError(err) {
+				metricRetryGiveUps.inc("not_retryable")
+				return result, err
+			}
+			if state.attempts > p.maxRetries {
+				metricRetryGiveUps.inc("exhausted")
+				return result, fmt.Errorf("max retries (%d) exceeded: %w", p.maxRetries, err)
+			}
+			delay := p.delay(err, state.attempts)
+			if p.maxElapsed > 0 && time.Since(state.started)+delay > p.maxElapsed {
+				metricRetryGiveUps.inc("elapsed")
+				return result, fmt.Errorf("retry time limit (%s) exceeded: %w", p.maxElapsed, err)
+			}
+			if p.failover && failsOver(err) {
+				metricRetryFailovers.inc()
+				return result, &failoverError{state: *state}
+			}
+
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_retryPolicy_delay(t *testing.T) {
+	p := retryPolicy{baseDelay: time.Second, maxDelay: 4 * time.Second}
+
+	if d := p.delay(&httpStatusError{statusCode: http.StatusTooManyRequests, throttled: true}, 3); d != 0 {
+		t.Errorf("expected a throttled 429 to go straight back to its client, got %s", d)
+	}
+	// An unlimited server's client sends the retry as soon as it's made, so
+	// the retry must back off itself.
+	for i := 0; i < 100; i++ {
+		if d := p.delay(&httpStatusError{statusCode: http.StatusTooManyRequests}, 3); d <= 0 || d > 4*time.Second {
+			t.Fatalf("expected an unthrottled 429 to back off within (0, 4s], got %s", d)
+		}
+	}
+	if d := p.delay(&httpStatusError{statusCode: http.StatusTooManyRequests, retryAfter: 7 * time.Second}, 1); d != 7*time.Second {
+		t.Errorf("expected Retry-After to be honoured, got %s", d)
+	}
+	for attempt, ceiling := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 40: 4 * time.Second} {
+		for i := 0; i < 100; i++ {
+			if d := p.delay(&httpStatusError{statusCode: http.StatusGatewayTimeout}, attempt); d < 0 || d > ceiling {
+				t.Fatalf("attempt %d: expected a delay within [0, %s], got %s", attempt, ceiling, d)
+			}
+		}
+	}
+}
+
+func Test_retrier(t *testing.T) {
+	serverErr := &httpStatusError{statusCode: http.StatusGatewayTimeout}
+	failing := func(calls *int, err error) func() (int, error) {
+		return func() (int, error) {
+			*calls++
+			return 0, err
+		}
+	}
+
+	t.Run("retries on the same endpoint", func(t *testing.T) {
+		var state retryState
+		var calls int
+		_, err := retrier[int](retryPolicy{maxRetries: 2})(context.Background(), &state, failing(&calls, serverErr))
+		if calls != 3 || state.attempts != 3 || !errors.Is(err, serverErr) {
+			t.Fatalf("expected 3 attempts ending in %v, got %d calls, %d attempts and %v", serverErr, calls, state.attempts, err)
+		}
+	})
+
+	t.Run("fails over to another endpoint", func(t *testing.T) {
+		var state retryState
+		var calls int
+		_, err := retrier[int](retryPolicy{maxRetries: 2, failover: true})(context.Background(), &state, failing(&calls, serverErr))
+		var failoverErr *failoverError
+		if !errors.As(err, &failoverErr) || calls != 1 || failoverErr.state.attempts != 1 {
+			t.Fatalf("expected a failover after 1 attempt, got %d calls and %v", calls, err)
+		}
+
+		// The unit's next endpoint picks up where this one left off.
+		state = failoverErr.state
+		calls = 0
+		_, err = retrier[int](retryPolicy{maxRetries: 2, failover: true})(context.Background(), &state, failing(&calls, serverErr))
+		if !errors.As(err, &failoverErr) || calls != 1 || failoverErr.state.attempts != 2 {
+			t.Fatalf("expected a second failover after 2 attempts in all, got %v", err)
+		}
+	})
+
+	t.Run("does not fail over when rate limited", func(t *testing.T) {
+		var state retryState
+		var calls int
+		rateLimited := &httpStatusError{statusCode: http.StatusTooManyRequests}
+		_, err := retrier[int](retryPolicy{maxRetries: 1, failover: true})(context.Background(), &state, failing(&calls, rateLimited))
+		if calls != 2 || !errors.Is(err, rateLimited) {
+			t.Fatalf("expected 2 attempts on the same endpoint, got %d calls and %v", calls, err)
+		}
+	})
+
+	t.Run("caps elapsed time", func(t *testing.T) {
+		state := retryState{started: time.Now().Add(-time.Hour)}
+		var calls int
+		_, err := retrier[int](retryPolicy{maxRetries: 5, maxElapsed: time.Minute})(context.Background(), &state, failing(&calls, serverErr))
+		if calls != 1 || !errors.Is(err, serverErr) {
+			t.Fatalf("expected to give up after 1 attempt, got %d calls and %v", calls, err)
+		}
+	})
+}
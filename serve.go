@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+)
+
+// maxUploadBytes bounds the size of an uploaded GPX file.
+const maxUploadBytes = 64 << 20
+
+const (
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	splitQueued  = "queued"
+	splitRunning = "running"
+	splitDone    = "done"
+	splitFailed  = "failed"
+	splitResplit = "resplit" // replaced by smaller splits
+)
+
+// serveMain implements the `serve` subcommand: an HTTP server hosting the
+// static triage UI alongside a JSON API for running jobs. Overpass clients are
+// provisioned once at startup and, like the cache, shared by every job.
+//
+// API:
+//
+//	GET  /api/profiles          names of the query profiles a job can use
+//	POST /api/jobs              start a job for an uploaded GPX (multipart
+//	                            field "gpx", or the raw request body); form or
+//	                            query values "profile", "split" and
+//	                            "name_prefix" mirror the CLI flags
+//	GET  /api/jobs/{id}         job state and per-split progress
+//	GET  /api/jobs/{id}/result  the resulting GeoJSON FeatureCollection
+func serveMain(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String(`addr`, `localhost:8080`, `address to listen on`)
+	webDir := fs.String(`web-dir`, `web`, `directory of static triage UI files to serve at /, "" disables`)
+	jobTTL := fs.Duration(`job-ttl`, time.Hour, `how long a finished job and its result are kept`)
+	lf := registerLogFlags(fs)
+	pf := registerPipelineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		// The usage has been printed for -h already.
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	if err := lf.setDefault(); err != nil {
+		return err
+	}
+	if err := pf.validate(); err != nil {
+		return err
+	}
+	if *jobTTL <= 0 {
+		return fmt.Errorf("job-ttl must be positive, got %v", *jobTTL)
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("serve takes no arguments, got %q", fs.Args())
+	}
+	config := pf.runConfig()
+	if len(config.endpoints) == 0 {
+		return fmt.Errorf("no overpass endpoints configured")
+	}
+
+	if *pf.metricsAddr != "" {
+		serveMetrics(*pf.metricsAddr)
+	}
+
+	if err := ensureCacheDir(config.cache.dir); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	clientsReady, waitProvisioned := provisionClients(ctx, config.endpoints, config.httpTimeout, config.cache.sharedSlotsDir(), nil, nil)
+	var clients []clientWorkers
+	for cw := range clientsReady {
+		clients = append(clients, cw)
+	}
+	defer func() {
+		for _, nc := range waitProvisioned() {
+			nc.client.Close()
+		}
+	}()
+	if len(clients) == 0 {
+		return fmt.Errorf("no overpass servers available")
+	}
+
+	s := &server{
+		ctx:     ctx,
+		clients: clients,
+		config:  config,
+		workers: newWorkerCap(config.workers),
+		jobTTL:  *jobTTL,
+		jobs:    make(map[string]*job),
+	}
+	httpServer := &http.Server{Addr: *addr, Handler: s.handler(*webDir)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutting down http server", "err", err)
+		}
+	}()
+
+	slog.Info("serving", "url", "http://"+*addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serving http: %w", err)
+	}
+	return nil
+}
+
+// server runs jobs on a fixed set of provisioned clients and tracks them in
+// memory, keeping each for jobTTL once it has finished.
+type server struct {
+	// ctx bounds every job; cancelling it aborts them all.
+	ctx     context.Context
+	clients []clientWorkers
+	// config configures every job, bar the settings each takes from its
+	// request.
+	config runConfig
+	// workers caps the queries running at once across every job; nil for no
+	// cap.
+	workers chan struct{}
+	jobTTL  time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func (s *server) handler(webDir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/profiles", s.listProfiles)
+	mux.HandleFunc("POST /api/jobs", s.createJob)
+	mux.HandleFunc("GET /api/jobs/{id}", s.getJob)
+	mux.HandleFunc("GET /api/jobs/{id}/result", s.getJobResult)
+	if webDir != "" {
+		mux.Handle("GET /", http.FileServer(http.Dir(webDir)))
+	}
+	return mux
+}
+
+// job is one run of the pipeline over an uploaded route.
+type job struct {
+	mu     sync.Mutex
+	status jobStatus
+	result []byte // encoded FeatureCollection, set once the job is done
+}
+
+type jobStatus struct {
+	ID       string        `json:"id"`
+	Profile  string        `json:"profile"`
+	State    string        `json:"state"` // jobRunning, jobDone or jobFailed
+	Error    string        `json:"error,omitempty"`
+	Created  time.Time     `json:"created"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	Splits   []splitStatus `json:"splits"`
+	POIs     int           `json:"pois"`
+}
+
+type splitStatus struct {
+	Split    int    `json:"split"` // 1-based, matching the log output
+	State    string `json:"state"` // splitQueued, splitRunning, splitDone, splitFailed or splitResplit
+	Endpoint string `json:"endpoint,omitempty"`
+	Cache    string `json:"cache,omitempty"`
+	Retries  int    `json:"retries,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Children are the splits a resplit split was replaced by.
+	Children []int `json:"children,omitempty"`
+}
+
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Splits = slices.Clone(j.status.Splits)
+	return status
+}
+
+func (j *job) finish(result []byte, pois int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.status.Finished = &now
+	if err != nil {
+		j.status.State = jobFailed
+		j.status.Error = err.Error()
+		return
+	}
+	j.status.State = jobDone
+	j.status.POIs = pois
+	j.result = result
+}
+
+// observe records each split's progress on the job from the run's events.
+func (j *job) observe(e runEvent) {
+	if e.Split == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Resplitting queues splits beyond those the job started with.
+	for len(j.status.Splits) < e.Split {
+		j.status.Splits = append(j.status.Splits, splitStatus{Split: len(j.status.Splits) + 1, State: splitQueued})
+	}
+	split := &j.status.Splits[e.Split-1]
+	switch e.Type {
+	case eventSplitStarted:
+		split.State = splitRunning
+		split.Endpoint = e.Endpoint
+	case eventSplitRetried:
+		split.Retries = e.Attempt
+	case eventSplitCompleted:
+		split.State = splitDone
+		split.Cache = e.Cache
+	case eventSplitFailed:
+		split.State = splitFailed
+		split.Error = e.Error
+	case eventSplitResplit:
+		split.State = splitResplit
+		split.Children = e.Children
+	case eventSplitFailover:
+		split.State = splitQueued
+		split.Error = e.Error
+	}
+}
+
+// run processes the job's units on the server's clients and records the
+// outcome. A job fails fast: the first split error fails the whole job.
+func (s *server) run(j *job, units []workUnit, namePrefix string) {
+	// Someone is waiting on a job, so its queries are granted slots ahead of
+	// any batch work sharing the servers.
+	ctx, cancel := context.WithCancel(overpass.WithPriority(s.ctx, overpass.PriorityHigh))
+	defer cancel()
+
+	// Every client is already provisioned, so hand them all over at once.
+	clientsReady := make(chan clientWorkers, len(s.clients))
+	for _, cw := range s.clients {
+		clientsReady <- cw
+	}
+	close(clientsReady)
+
+	var resplit *resplitter
+	if s.config.resplitMinPoints > 0 {
+		resplit = newResplitter(s.config.resplitMinPoints, len(units))
+	}
+	processUnit := unitProcessor(ctx, s.config.cache, retrier[queryOutcome](s.config.retry), s.config.settings, resplit, j.observe)
+	results, err := concurrentUnitsWorker(ctx, cancel, clientsReady, processUnit, routeUnit, true, s.workers)(units...)
+	if err != nil {
+		j.finish(nil, 0, err)
+		return
+	}
+
+	pois, getStats, err := collectPois(results, namePrefix)
+	if err != nil {
+		j.finish(nil, 0, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writePois(pois, getStats, &buf); err != nil {
+		j.finish(nil, 0, fmt.Errorf("writing pois: %w", err))
+		return
+	}
+	j.finish(buf.Bytes(), len(pois), nil)
+}
+
+func (s *server) listProfiles(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, slices.Sorted(maps.Keys(profiles)))
+}
+
+func (s *server) createJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+
+	params, err := jobParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	profile := params.Get("profile")
+	if profile == "" {
+		profile = "default"
+	}
+	profileQueries, ok := profiles[profile]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown profile %q", profile))
+		return
+	}
+
+	split := uint64(5)
+	if v := params.Get("split"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 0)
+		if err != nil || n == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("split must be a positive integer, got %q", v))
+			return
+		}
+		split = n
+	}
+
+	gpx, err := uploadedGPX(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	pts, err := parseRoute(gpx)
+	_ = gpx.Close()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	units := splitWorkUnits(pts, uint(split), profileQueries)
+	j := &job{status: jobStatus{
+		ID:      id,
+		Profile: profile,
+		State:   jobRunning,
+		Created: time.Now(),
+		Splits:  make([]splitStatus, len(units)),
+	}}
+	for i := range j.status.Splits {
+		j.status.Splits[i] = splitStatus{Split: i + 1, State: splitQueued}
+	}
+
+	s.mu.Lock()
+	s.evictFinished(time.Now())
+	s.jobs[id] = j
+	s.mu.Unlock()
+
+	slog.Info("job started", "job", id, "points", len(pts), "splits", len(units), "profile", profile)
+	go s.run(j, units, params.Get("name_prefix"))
+
+	w.Header().Set("Location", "/api/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, j.snapshot())
+}
+
+// jobParams returns the job parameters sent with r: the form values of a
+// multipart upload, or else the URL query alone, as the body is the GPX
+// document itself, whatever its content type says.
+func jobParams(r *http.Request) (url.Values, error) {
+	if !multipartUpload(r) {
+		return r.URL.Query(), nil
+	}
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil {
+		return nil, fmt.Errorf("parsing multipart form: %w", err)
+	}
+	return r.Form, nil
+}
+
+// multipartUpload reports whether r uploads the GPX document as a multipart
+// form.
+func multipartUpload(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// uploadedGPX returns the GPX document from a multipart "gpx" field, or the
+// raw request body for any other content type.
+func uploadedGPX(r *http.Request) (io.ReadCloser, error) {
+	if !multipartUpload(r) {
+		return r.Body, nil
+	}
+	f, _, err := r.FormFile("gpx")
+	if err != nil {
+		return nil, fmt.Errorf("reading gpx form file: %w", err)
+	}
+	return f, nil
+}
+
+// evictFinished drops the jobs that finished more than jobTTL before now.
+// s.mu must be held.
+func (s *server) evictFinished(now time.Time) {
+	maps.DeleteFunc(s.jobs, func(_ string, j *job) bool {
+		finished := j.snapshot().Finished
+		return finished != nil && now.Sub(*finished) > s.jobTTL
+	})
+}
+
+func (s *server) lookupJob(w http.ResponseWriter, r *http.Request) (*job, bool) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %q", id))
+	}
+	return j, ok
+}
+
+func (s *server) getJob(w http.ResponseWriter, r *http.Request) {
+	if j, ok := s.lookupJob(w, r); ok {
+		writeJSON(w, http.StatusOK, j.snapshot())
+	}
+}
+
+func (s *server) getJobResult(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	status := j.snapshot()
+	switch status.State {
+	case jobRunning:
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s is still running", status.ID))
+		return
+	case jobFailed:
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s failed: %s", status.ID, status.Error))
+		return
+	}
+	j.mu.Lock()
+	result := j.result
+	j.mu.Unlock()
+	w.Header().Set("Content-Type", "application/geo+json")
+	if _, err := w.Write(result); err != nil {
+		slog.Warn("writing job result", "job", status.ID, "err", err)
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating job id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("writing json response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
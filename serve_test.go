@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glynternet/route-poi-finder/overpass"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+<trk><trkseg>
+<trkpt lat="51.000" lon="-1.000"></trkpt>
+<trkpt lat="51.010" lon="-1.010"></trkpt>
+<trkpt lat="51.020" lon="-1.020"></trkpt>
+<trkpt lat="51.030" lon="-1.030"></trkpt>
+</trkseg></trk>
+</gpx>`
+
+// fakeOverpass serves an unlimited /api/status and answers every interpreter
+// query with a single cafe, calling query, when non-nil, before answering.
+func fakeOverpass(t *testing.T, query func()) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("Connected as: 1\nRate limit: 0\n"))
+	})
+	mux.HandleFunc("/api/interpreter", func(w http.ResponseWriter, _ *http.Request) {
+		if query != nil {
+			query()
+		}
+		_, _ = w.Write([]byte(`{"osm3s":{"timestamp_osm_base":"2024-01-01T00:00:00Z"},"elements":[` +
+			`{"type":"node","id":1,"lat":51.0,"lon":-1.0,"tags":{"amenity":"cafe","name":"Test Cafe"}}]}`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testServer(t *testing.T) *server {
+	t.Helper()
+	return testServerFor(t, fakeOverpass(t, nil))
+}
+
+// testServerFor returns a server running jobs on the Overpass server fake,
+// through a client configured with opts.
+func testServerFor(t *testing.T, fake *httptest.Server, opts ...overpass.Option) *server {
+	t.Helper()
+	c := overpass.NewClient(fake.URL+"/api/interpreter", fake.URL+"/api/status", 10*time.Second, opts...)
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("starting client: %v", err)
+	}
+	t.Cleanup(c.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &server{
+		ctx:     ctx,
+		clients: []clientWorkers{{client: namedClient{name: "fake", client: c}, capacity: 2}},
+		config: runConfig{
+			cache: cacheConfig{dir: t.TempDir(), ttl: time.Hour},
+			retry: newRetryPolicy(0),
+		},
+		jobTTL: time.Hour,
+		jobs:   make(map[string]*job),
+	}
+}
+
+func Test_server_jobLifecycle(t *testing.T) {
+	api := httptest.NewServer(testServer(t).handler(""))
+	defer api.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("gpx", "route.gpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write([]byte(testGPX))
+	_ = mw.WriteField("split", "2")
+	_ = mw.Close()
+
+	resp, err := http.Post(api.URL+"/api/jobs", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+	var created jobStatus
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	if len(created.Splits) != 2 {
+		t.Fatalf("expected 2 splits, got %+v", created.Splits)
+	}
+
+	status := awaitJob(t, api.URL, created.ID)
+	if status.State != jobDone {
+		t.Fatalf("expected job to be done, got %+v", status)
+	}
+	for _, split := range status.Splits {
+		if split.State != splitDone || split.Endpoint != "fake" {
+			t.Fatalf("unexpected split status %+v", split)
+		}
+	}
+
+	resp, err = http.Get(api.URL + "/api/jobs/" + created.ID + "/result")
+	if err != nil {
+		t.Fatalf("fetching result: %v", err)
+	}
+	var fc featureCollection
+	_ = json.NewDecoder(resp.Body).Decode(&fc)
+	_ = resp.Body.Close()
+	if len(fc.Features) != 1 || fc.Features[0].ID != "node/1" || fc.Features[0].Properties.Name != "Test Cafe" {
+		t.Fatalf("unexpected result %+v", fc)
+	}
+}
+
+// A raw GPX body takes its parameters from the URL query, even when sent
+// with a form content type, which would otherwise have the body parsed as a
+// form.
+func Test_server_rawBodyParams(t *testing.T) {
+	api := httptest.NewServer(testServer(t).handler(""))
+	defer api.Close()
+
+	resp, err := http.Post(api.URL+"/api/jobs?split=2", "application/x-www-form-urlencoded", bytes.NewBufferString(testGPX))
+	if err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+	var created jobStatus
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	if len(created.Splits) != 2 {
+		t.Fatalf("expected 2 splits, got %+v", created.Splits)
+	}
+	if status := awaitJob(t, api.URL, created.ID); status.State != jobDone {
+		t.Fatalf("expected job to be done, got %+v", status)
+	}
+}
+
+// awaitJob polls the API at url until job id is no longer running.
+func awaitJob(t *testing.T, url, id string) jobStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(url + "/api/jobs/" + id)
+		if err != nil {
+			t.Fatalf("polling job: %v", err)
+		}
+		var status jobStatus
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		_ = resp.Body.Close()
+		if status.State != jobRunning {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// --workers caps the queries running at once across every job, not per job.
+func Test_server_workersSharedAcrossJobs(t *testing.T) {
+	var track concurrencyTracker
+	s := testServerFor(t, fakeOverpass(t, func() {
+		track.enter()
+		time.Sleep(20 * time.Millisecond)
+		track.leave()
+	}))
+	s.workers = newWorkerCap(1)
+	api := httptest.NewServer(s.handler(""))
+	defer api.Close()
+
+	// Routes apart, so neither job's queries are answered from the other's
+	// cache.
+	var ids []string
+	for _, route := range []string{testGPX, strings.ReplaceAll(testGPX, `lat="51.`, `lat="52.`)} {
+		resp, err := http.Post(api.URL+"/api/jobs?split=2", "application/gpx+xml", strings.NewReader(route))
+		if err != nil {
+			t.Fatalf("creating job: %v", err)
+		}
+		var created jobStatus
+		_ = json.NewDecoder(resp.Body).Decode(&created)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", resp.StatusCode)
+		}
+		ids = append(ids, created.ID)
+	}
+	for _, id := range ids {
+		if status := awaitJob(t, api.URL, id); status.State != jobDone {
+			t.Fatalf("expected job to be done, got %+v", status)
+		}
+	}
+	if peak := atomic.LoadInt64(&track.peak); peak != 1 {
+		t.Errorf("expected at most 1 query at once across jobs, got %d", peak)
+	}
+}
+
+// A job's splits are granted slots on a rate-limited server ahead of batch
+// work already queued for them.
+func Test_server_jobOutranksQueuedBatchWork(t *testing.T) {
+	// The server has one slot, reported free once after each call to free.
+	var mu sync.Mutex
+	available := 0
+	free := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		available = 1
+	}
+	queried := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = fmt.Fprintf(w, "Connected as: 1\nRate limit: 1\n%d slots available now.\n", available)
+		available = 0
+	})
+	mux.HandleFunc("/api/interpreter", func(w http.ResponseWriter, _ *http.Request) {
+		queried <- struct{}{}
+		_, _ = w.Write([]byte(`{"osm3s":{"timestamp_osm_base":"2024-01-01T00:00:00Z"},"elements":[]}`))
+	})
+	fake := httptest.NewServer(mux)
+	defer fake.Close()
+
+	queued := make(chan int, 10)
+	s := testServerFor(t, fake, overpass.WithHooks(overpass.Hooks{QueueLength: func(n int) { queued <- n }}))
+	c := s.clients[0].client.client
+	awaitQueued := func(want int) {
+		t.Helper()
+		for n := range queued {
+			if n == want {
+				return
+			}
+		}
+	}
+
+	// Batch work holds the slot, and more is queued behind it.
+	free()
+	held, err := c.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquiring slot: %v", err)
+	}
+	batchGranted := make(chan struct{})
+	go func() {
+		slot, err := c.Acquire(context.Background())
+		if err != nil {
+			t.Errorf("acquiring slot: %v", err)
+			return
+		}
+		close(batchGranted)
+		slot.Release()
+	}()
+	awaitQueued(1)
+
+	api := httptest.NewServer(s.handler(""))
+	defer api.Close()
+	resp, err := http.Post(api.URL+"/api/jobs?split=1", "application/gpx+xml", strings.NewReader(testGPX))
+	if err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+	var created jobStatus
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+	_ = resp.Body.Close()
+	awaitQueued(2)
+
+	free()
+	held.Release()
+	select {
+	case <-queried:
+	case <-batchGranted:
+		t.Fatal("expected the job's split to be granted the slot before the queued batch work")
+	case <-time.After(10 * time.Second):
+		t.Fatal("no slot granted")
+	}
+	if status := awaitJob(t, api.URL, created.ID); status.State != jobDone {
+		t.Fatalf("expected job to be done, got %+v", status)
+	}
+	free()
+	select {
+	case <-batchGranted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the batch work to be granted the slot next")
+	}
+}
+
+// Finished jobs are kept for the job TTL, and running jobs however old.
+func Test_server_evictFinished(t *testing.T) {
+	now := time.Now()
+	finished := func(ago time.Duration) *job {
+		at := now.Add(-ago)
+		return &job{status: jobStatus{State: jobDone, Finished: &at}}
+	}
+	s := &server{jobTTL: time.Hour, jobs: map[string]*job{
+		"running": {status: jobStatus{State: jobRunning, Created: now.Add(-2 * time.Hour)}},
+		"recent":  finished(time.Minute),
+		"expired": finished(2 * time.Hour),
+	}}
+	s.evictFinished(now)
+	if got := slices.Sorted(maps.Keys(s.jobs)); !slices.Equal(got, []string{"recent", "running"}) {
+		t.Errorf("expected the expired job to be evicted, got %q", got)
+	}
+}
+
+func Test_server_rejectsBadRequests(t *testing.T) {
+	api := httptest.NewServer(testServer(t).handler(""))
+	defer api.Close()
+
+	resp, err := http.Post(api.URL+"/api/jobs?profile=nope", "application/gpx+xml", bytes.NewBufferString(testGPX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown profile: expected 400, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(api.URL+"/api/jobs", "application/gpx+xml", bytes.NewBufferString("not gpx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad gpx: expected 400, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(api.URL + "/api/jobs/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing job: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func Test_serveMain_flags(t *testing.T) {
+	if err := serveMain([]string{"-no-such-flag"}); err == nil {
+		t.Error("expected an unknown flag to be an error")
+	}
+	if err := serveMain([]string{"-h"}); err != nil {
+		t.Errorf("expected -h not to be an error, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// sharedSlotsDir is the directory in the cache dir holding a state file for
+// each Overpass server whose slots are shared with --share-slots.
+const sharedSlotsDir = "slots"
+
+// sharedSlotsPoll is how often a process waiting for a shared slot looks for
+// one to have been given back.
+const sharedSlotsPoll = 250 * time.Millisecond
+
+// slotLeaseIDs numbers the shared slots this process takes, so it can tell
+// them apart in a state file.
+var slotLeaseIDs atomic.Int64
+
+// fileSlots are a server's slots, shared by every route-poi-finder process on
+// the host through a state file listing the slots taken. The file is locked
+// while it is read and rewritten, so slots are taken one at a time, and a
+// process waiting for a slot polls the file. A slot given back stays listed
+// until the server frees it after its cooldown, and slots held by a process
+// that has exited, even one whose PID has since been reused, are reclaimed by
+// the next process to look.
+type fileSlots struct {
+	path string
+	poll time.Duration
+}
+
+// slotLease is a shared slot taken by a process.
+type slotLease struct {
+	PID     int       `json:"pid"`
+	Started string    `json:"started"` // when the process started, as processStarted has it
+	ID      int64     `json:"id"`
+	Taken   time.Time `json:"taken"`
+	// FreeAt, once the slot is given back, is when its cooldown ends.
+	FreeAt time.Time `json:"free_at"`
+}
+
+// held reports whether the lease still counts against the server's slots at
+// now.
+func (l slotLease) held(now time.Time) bool {
+	if l.FreeAt.IsZero() {
+		// Where it can't be told when the process running as PID started,
+		// take it to be the one that took the lease.
+		started := processStarted(l.PID)
+		return processAlive(l.PID) && (started == "" || started == l.Started)
+	}
+	return l.FreeAt.After(now)
+}
+
+// slotState is the content of a fileSlots state file.
+type slotState struct {
+	Leases []slotLease `json:"leases"`
+}
+
+// newFileSlots returns the slots of the server with the interpreter URL
+// interpreter, shared through a state file in dir. Processes configuring the
+// server under different names still share its slots.
+func newFileSlots(dir, interpreter string) (*fileSlots, error) {
+	if !slotSharingSupported {
+		return nil, errors.New("sharing slots between processes is not supported on this platform")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating shared slots dir: %w", err)
+	}
+	sum := sha256.Sum256([]byte(interpreter))
+	return &fileSlots{
+		path: filepath.Join(dir, hex.EncodeToString(sum[:8])+".json"),
+		poll: sharedSlotsPoll,
+	}, nil
+}
+
+// Acquire implements overpass.SharedSlots.
+func (s *fileSlots) Acquire(ctx context.Context, limit int) (release func(freeAt time.Time), err error) {
+	lease := slotLease{PID: os.Getpid(), Started: processStarted(os.Getpid()), ID: slotLeaseIDs.Add(1)}
+	for {
+		var taken bool
+		err := s.update(func(state *slotState) {
+			now := time.Now()
+			state.Leases = slices.DeleteFunc(state.Leases, func(l slotLease) bool {
+				return !l.held(now)
+			})
+			if len(state.Leases) < limit {
+				lease.Taken = now
+				state.Leases = append(state.Leases, lease)
+				taken = true
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return func(freeAt time.Time) { s.release(lease, freeAt) }, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.poll):
+		}
+	}
+}
+
+// release gives back lease, whose slot the server frees at freeAt. Should
+// that fail, the slot is held until this process exits.
+func (s *fileSlots) release(lease slotLease, freeAt time.Time) {
+	err := s.update(func(state *slotState) {
+		i := slices.IndexFunc(state.Leases, func(l slotLease) bool {
+			return l.PID == lease.PID && l.ID == lease.ID
+		})
+		switch {
+		case i < 0:
+		case freeAt.After(time.Now()):
+			state.Leases[i].FreeAt = freeAt
+		default:
+			state.Leases = slices.Delete(state.Leases, i, i+1)
+		}
+	})
+	if err != nil {
+		slog.Warn("giving back shared slot", "state", s.path, "err", err)
+	}
+}
+
+// update applies fn to the state file's content with the file locked.
+func (s *fileSlots) update(fn func(state *slotState)) error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening shared slots state: %w", err)
+	}
+	defer f.Close()
+	unlock, err := lockFile(f)
+	if err != nil {
+		return fmt.Errorf("locking shared slots state: %w", err)
+	}
+	defer unlock()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("reading shared slots state: %w", err)
+	}
+	var state slotState
+	// A new state file is empty.
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &state); err != nil {
+			return fmt.Errorf("decoding shared slots state: %w", err)
+		}
+	}
+	fn(&state)
+	if b, err = json.Marshal(state); err != nil {
+		return fmt.Errorf("encoding shared slots state: %w", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("writing shared slots state: %w", err)
+	}
+	if _, err := f.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("writing shared slots state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !unix || aix || solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// slotSharingSupported is false where there is no flock to guard the shared
+// slots' state file with.
+const slotSharingSupported = false
+
+func lockFile(*os.File) (unlock func(), err error) {
+	return nil, errors.ErrUnsupported
+}
+
+func processAlive(int) bool { return true }
+
+func processStarted(int) string { return "" }
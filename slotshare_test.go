@@ -0,0 +1,106 @@
+//go:build unix && !aix && !solaris
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func Test_fileSlots(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *fileSlots {
+		t.Helper()
+		s, err := newFileSlots(dir, "https://overpass.example/api/interpreter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.poll = time.Millisecond
+		return s
+	}
+	// Two processes' views of the same server's slots.
+	a, b := open(), open()
+
+	releaseA, err := a.Acquire(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseB, err := b.Acquire(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := a.Acquire(ctx, 2); err == nil {
+		t.Fatal("expected both slots to be taken")
+	}
+	releaseB(time.Now())
+	release, err := a.Acquire(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("expected the slot given back to be taken, got %v", err)
+	}
+
+	// A slot given back is held until its cooldown ends.
+	const cooldown = 50 * time.Millisecond
+	released := time.Now()
+	release(released.Add(cooldown))
+	if _, err := b.Acquire(context.Background(), 2); err != nil {
+		t.Fatalf("expected the slot to be taken after its cooldown, got %v", err)
+	}
+	if waited := time.Since(released); waited < cooldown {
+		t.Errorf("expected the slot to be held for its %v cooldown, taken again after %v", cooldown, waited)
+	}
+	releaseA(time.Now())
+
+	// A slot held by a process that has exited is reclaimed.
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skipf("running a process to exit: %v", err)
+	}
+	state, err := json.Marshal(slotState{Leases: []slotLease{{PID: exited.Process.Pid, ID: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(a.path, state, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err = b.Acquire(ctx, 1)
+	if err != nil {
+		t.Fatalf("expected the exited process's slot to be reclaimed, got %v", err)
+	}
+	release(time.Now())
+}
+
+// A slot held by a process that has exited is reclaimed even once another
+// process has reused its PID.
+func Test_fileSlots_reusedPID(t *testing.T) {
+	if processStarted(os.Getpid()) == "" {
+		t.Skip("process start times are not available on this host")
+	}
+	s, err := newFileSlots(t.TempDir(), "https://overpass.example/api/interpreter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.poll = time.Millisecond
+	// This process has reused the PID of the one that took the lease.
+	state, err := json.Marshal(slotState{Leases: []slotLease{{PID: os.Getpid(), Started: "earlier", ID: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.path, state, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err := s.Acquire(ctx, 1)
+	if err != nil {
+		t.Fatalf("expected the slot of the process that first had the PID to be reclaimed, got %v", err)
+	}
+	release(time.Now())
+}